@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Bitstream files start with a header: a fixed 9 byte preamble followed by
+// keyed fields a (design), b (part), c (date) and d (time), each one a 16 bit
+// length and a null terminated string. Field e is the configuration data.
+//
+
+type BitstreamHeader struct {
+	Design string
+	Part   string
+	Date   string
+	Time   string
+}
+
+var bitstreamPreamble = []byte{0x0f, 0xf0, 0x0f, 0xf0, 0x0f, 0xf0, 0x0f, 0xf0, 0x00}
+
+// ReadBitstreamHeader reads header of a .bit file
+func ReadBitstreamHeader(path string) (*BitstreamHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Header is way shorter than that, configuration data follows
+	data := make([]byte, 1024)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header, err := parseBitstreamHeader(data[:n])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitstream %s: %v", path, err)
+	}
+	return header, nil
+}
+
+func parseBitstreamHeader(data []byte) (*BitstreamHeader, error) {
+	if len(data) < 2+len(bitstreamPreamble)+2 || binary.BigEndian.Uint16(data) != uint16(len(bitstreamPreamble)) ||
+		!bytes.Equal(data[2:2+len(bitstreamPreamble)], bitstreamPreamble) {
+		return nil, errors.New("missing preamble")
+	}
+	data = data[2+len(bitstreamPreamble):]
+
+	// Number of keys that follow, always one
+	data = data[2:]
+
+	header := &BitstreamHeader{}
+	fields := map[byte]*string{'a': &header.Design, 'b': &header.Part, 'c': &header.Date, 'd': &header.Time}
+	for {
+		if len(data) == 0 {
+			return nil, errors.New("truncated header")
+		}
+		key := data[0]
+		if key == 'e' {
+			break
+		}
+		field, found := fields[key]
+		if !found {
+			return nil, fmt.Errorf("unknown field %02x", key)
+		}
+		if len(data) < 3 {
+			return nil, errors.New("truncated header")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+length {
+			return nil, errors.New("truncated header")
+		}
+		*field = strings.TrimRight(string(data[3:3+length]), "\x00")
+		data = data[3+length:]
+	}
+	if header.Part == "" {
+		return nil, errors.New("missing part")
+	}
+
+	// Design name is followed by build options
+	header.Design = strings.SplitN(header.Design, ";", 2)[0]
+	return header, nil
+}
+
+// BitstreamFamily selects chip family by part of a bitstream
+func BitstreamFamily(path string) (*xilinx.Family, *BitstreamHeader, error) {
+	header, err := ReadBitstreamHeader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	family, err := xilinx.FindFamily(header.Part)
+	if err != nil {
+		return nil, header, err
+	}
+	return family, header, nil
+}
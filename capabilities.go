@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Bitstreams report own protocol version in the frame header and answer info
+// queries of 0xA2 command. Old bitstreams doesn't answer the queries at all and
+// are assumed to have default capabilities.
+//
+
+// ChipCapabilities describes what a bitstream loaded to a chip supports
+type ChipCapabilities struct {
+	Version  uint8
+	CoinID   uint32
+	Cores    int
+	Prefixes int
+	Features uint32
+}
+
+var DefaultCapabilities = ChipCapabilities{
+	Version:  0,
+	CoinID:   0,
+	Cores:    IterationsMultiplier,
+	Prefixes: 4,
+	Features: 0,
+}
+
+func (caps *ChipCapabilities) Supports(feature uint32) bool {
+	return caps.Features&feature == feature
+}
+
+func (caps *ChipCapabilities) String() string {
+	return fmt.Sprintf("version=%d coin=%d cores=%d prefixes=%d features=%08x", caps.Version, caps.CoinID, caps.Cores, caps.Prefixes, caps.Features)
+}
+
+// HandshakeAttempts is how many times an info query is sent before chip is
+// considered not answering it, a single lost frame should not change the result
+const HandshakeAttempts = 3
+
+// Handshake queries capabilities of a chip and switches it to push job events
+// when it could
+func (channel *SerialChannel) Handshake(chipId int) (*ChipCapabilities, error) {
+	caps, err := channel.QueryCapabilities(chipId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer completion events over polling
+	enabled, err := channel.EnableJobEvents(chipId)
+	if err != nil {
+		log.Printf("[%v] Unable to enable job events for chip %d, polling: %v", channel.Tag, chipId, err)
+	} else if enabled {
+		log.Printf("[%v] Chip %d pushes job events", channel.Tag, chipId)
+	}
+
+	return caps, nil
+}
+
+// QueryCapabilities queries capabilities of a chip and stores them in the
+// channel, configuration of the chip is not changed
+func (channel *SerialChannel) QueryCapabilities(chipId int) (*ChipCapabilities, error) {
+	caps := DefaultCapabilities
+
+	// Coin ID, also used to detect if bitstream supports queries at all
+	frame, err := channel.requestInfo(chipId, protocol.ChipInfoCoinID)
+	if err != nil {
+		log.Printf("[%v] Chip %d does not report capabilities (%v), using defaults", channel.Tag, chipId, err)
+		channel.setCapabilities(chipId, &caps)
+		return &caps, nil
+	}
+	caps.Version = frame.Version
+	if caps.CoinID, err = parseUint(frame.Data); err != nil {
+		return nil, err
+	}
+
+	// Cores
+	frame, err = channel.requestInfo(chipId, protocol.ChipInfoCores)
+	if err != nil {
+		return nil, err
+	}
+	cores, err := parseUint(frame.Data)
+	if err != nil {
+		return nil, err
+	}
+	if cores == 0 {
+		return nil, errors.New("chip reported zero cores")
+	}
+	caps.Cores = int(cores)
+	caps.Prefixes = int(cores)
+
+	// Features are only known starting from protocol version 1
+	if caps.Version >= 1 {
+		frame, err = channel.requestInfo(chipId, protocol.ChipInfoFeatures)
+		if err != nil {
+			return nil, err
+		}
+		if caps.Features, err = parseUint(frame.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	channel.setCapabilities(chipId, &caps)
+	return &caps, nil
+}
+
+// requestInfo sends info query, retrying it when chip doesn't answer
+func (channel *SerialChannel) requestInfo(chipId int, info uint8) (*protocol.Frame, error) {
+	var frame *protocol.Frame
+	var err error
+	for attempt := 0; attempt < HandshakeAttempts; attempt++ {
+		frame, err = channel.Request(chipId, 0xA2, []byte{info})
+		if err != ErrRequestTimeout {
+			break
+		}
+	}
+	return frame, err
+}
+
+// Capabilities returns capabilities found by handshake or defaults
+func (channel *SerialChannel) Capabilities(chipId int) *ChipCapabilities {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	caps, found := channel.capabilities[chipId]
+	if !found {
+		res := DefaultCapabilities
+		return &res
+	}
+	return caps
+}
+
+func (channel *SerialChannel) setCapabilities(chipId int, caps *ChipCapabilities) {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	channel.capabilities[chipId] = caps
+}
+
+func parseUint(data []byte) (uint32, error) {
+	if len(data) == 0 || len(data) > 4 {
+		return 0, fmt.Errorf("invalid integer: %x", data)
+	}
+	var res uint32
+	for _, b := range data {
+		res = res<<8 | uint32(b)
+	}
+	return res, nil
+}
+
+// Family returns family of a chip, chips are 7-series unless set otherwise
+func (channel *SerialChannel) Family(chipId int) *xilinx.Family {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	family, found := channel.families[chipId]
+	if !found {
+		return &xilinx.Series7
+	}
+	return family
+}
+
+func (channel *SerialChannel) SetFamily(chipId int, family *xilinx.Family) {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	channel.families[chipId] = family
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+)
+
+//
+// Capture records every frame sent and received over serial channels into a
+// JSONL file, one record per frame, so protocol issues could be reproduced offline.
+// Bytes are also recorded as they were read from the port, before decoding,
+// so garbage and rejected frames could be fed to the decoder again.
+//
+
+const (
+	CaptureTx = "tx"
+	CaptureRx = "rx"
+	// CaptureRxBytes is a chunk of bytes as it was read from the port
+	CaptureRxBytes = "rxbytes"
+)
+
+type CaptureRecord struct {
+	Time    time.Time `json:"time"`
+	Port    string    `json:"port"`
+	Dir     string    `json:"dir"`
+	Version uint8     `json:"version"`
+	ChipID  uint8     `json:"chip"`
+	Type    uint8     `json:"type"`
+	Length  int       `json:"length"`
+	Data    string    `json:"data"`
+	Raw     string    `json:"raw,omitempty"`
+}
+
+type Capture struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// activeCapture is attached to every channel opened after capture was enabled
+var activeCapture *Capture
+
+func OpenCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Record writes a frame, raw is the packed frame as written to the port
+func (capture *Capture) Record(port string, dir string, frame *protocol.Frame, raw []byte) {
+	capture.write(&CaptureRecord{
+		Time:    time.Now(),
+		Port:    port,
+		Dir:     dir,
+		Version: frame.Version,
+		ChipID:  frame.ChipID,
+		Type:    frame.Type,
+		Length:  len(frame.Data),
+		Data:    hex.EncodeToString(frame.Data),
+		Raw:     hex.EncodeToString(raw),
+	})
+}
+
+// RecordBytes writes bytes read from the port before they are decoded
+func (capture *Capture) RecordBytes(port string, data []byte) {
+	capture.write(&CaptureRecord{
+		Time:   time.Now(),
+		Port:   port,
+		Dir:    CaptureRxBytes,
+		Length: len(data),
+		Data:   hex.EncodeToString(data),
+	})
+}
+
+func (capture *Capture) write(record *CaptureRecord) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	capture.encoder.Encode(record)
+}
+
+func (capture *Capture) Close() error {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	return capture.file.Close()
+}
+
+// captureReader records everything read from the port
+type captureReader struct {
+	reader  io.Reader
+	capture *Capture
+	port    string
+}
+
+func (reader *captureReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.capture.RecordBytes(reader.port, p[:n])
+	}
+	return n, err
+}
+
+func loadCapture(path string) ([]CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]CaptureRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*protocol.MaxFrameLength)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid record at line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+//
+// Replay
+//
+
+// printCapture pretty prints capture, responses are decoded using the last
+// request sent to the same chip since frames doesn't carry command
+func printCapture(records []CaptureRecord) {
+	lastCommand := make(map[string]byte)
+	var start time.Time
+	for i, record := range records {
+		if i == 0 {
+			start = record.Time
+		}
+
+		// Received bytes are only used for decoder replay
+		if record.Dir == CaptureRxBytes {
+			continue
+		}
+		data, _ := hex.DecodeString(record.Data)
+		key := fmt.Sprintf("%s/%d/%d", record.Port, record.ChipID, record.Type)
+		if record.Dir == CaptureTx && len(data) > 0 {
+			lastCommand[key] = data[0]
+		}
+		fmt.Printf("%12.6f %-12s %s chip=%-3d type=%02x len=%-4d %s\n",
+			record.Time.Sub(start).Seconds(), record.Port, record.Dir, record.ChipID, record.Type, record.Length,
+			describeFrame(record.Dir, record.Type, lastCommand[key], data))
+	}
+}
+
+func describeFrame(dir string, reqType uint8, command byte, data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	if reqType == 0xA2 {
+		switch {
+		case dir == CaptureTx && data[0] == protocol.PllRead && len(data) == 2:
+			return fmt.Sprintf("pll read  addr=%02x", data[1])
+		case dir == CaptureTx && data[0] == protocol.PllWrite && len(data) == 4:
+			return fmt.Sprintf("pll write addr=%02x value=%04x", data[1], binary.BigEndian.Uint16(data[2:]))
+		case dir == CaptureTx && data[0] == protocol.PllLock && len(data) == 1:
+			return "pll lock status"
+		case dir == CaptureRx && command == protocol.PllLock && len(data) == 1:
+			return fmt.Sprintf("pll locked=%v", data[0] != 0)
+		case dir == CaptureRx && len(data) == 2:
+			return fmt.Sprintf("pll value=%04x", binary.BigEndian.Uint16(data))
+		}
+		return fmt.Sprintf("pll %x", data)
+	}
+	if reqType == protocol.JobEventType {
+		command = 0x9a
+	} else if dir == CaptureTx {
+		switch data[0] {
+		case protocol.JobSubmit:
+			if len(data) >= 5 {
+				return fmt.Sprintf("job submit id=%d payload=%x", binary.BigEndian.Uint32(data[1:]), data[5:])
+			}
+		case protocol.JobSubmitTarget:
+			if len(data) >= 5+33 {
+				return fmt.Sprintf("job submit id=%d payload=%x target=%x max=%d", binary.BigEndian.Uint32(data[1:]),
+					data[5:len(data)-33], data[len(data)-33:len(data)-1], data[len(data)-1])
+			}
+		case 0x9a:
+			return "job status"
+		case protocol.JobAbort:
+			return "job abort"
+		case protocol.SysmonCommand:
+			if len(data) == 5 && data[1] == protocol.SysmonRead {
+				return fmt.Sprintf("sysmon read  addr=%02x", data[2])
+			}
+			if len(data) == 5 && data[1] == protocol.SysmonWrite {
+				return fmt.Sprintf("sysmon write addr=%02x value=%04x", data[2], binary.BigEndian.Uint16(data[3:]))
+			}
+			return fmt.Sprintf("sysmon %x", data[1:])
+		}
+		return fmt.Sprintf("%x", data)
+	}
+	switch command {
+	case 0x9a:
+		if len(data) < 5 {
+			return fmt.Sprintf("job state=%d", data[0])
+		}
+		res := fmt.Sprintf("job state=%d id=%d", data[0], binary.BigEndian.Uint32(data[1:]))
+		if len(data) == 5+40 {
+			res += fmt.Sprintf(" hash=%x nonce=%x prefix=%d", data[5:37], data[37:41], binary.BigEndian.Uint32(data[41:45]))
+		} else if len(data) > 5 {
+			res += fmt.Sprintf(" results=%d %x", data[5], data[6:])
+		}
+		return res
+	case protocol.JobAbort:
+		if len(data) == 2 {
+			return fmt.Sprintf("job aborted state=%d", data[1])
+		}
+	case protocol.SysmonCommand:
+		if len(data) >= 3 {
+			return fmt.Sprintf("sysmon value=%04x", binary.BigEndian.Uint16(data[1:]))
+		}
+	}
+	return fmt.Sprintf("%x", data)
+}
+
+// replayDecoder feeds bytes received by every port, as they were read from it
+// including garbage and rejected frames, into a frame decoder and compares
+// decoded frames with the recorded ones
+func replayDecoder(records []CaptureRecord) error {
+	streams := make(map[string]*bytes.Buffer)
+	expected := make(map[string][]CaptureRecord)
+	for _, record := range records {
+		switch record.Dir {
+		case CaptureRxBytes:
+			data, err := hex.DecodeString(record.Data)
+			if err != nil {
+				return err
+			}
+			if streams[record.Port] == nil {
+				streams[record.Port] = &bytes.Buffer{}
+			}
+			streams[record.Port].Write(data)
+		case CaptureRx:
+			expected[record.Port] = append(expected[record.Port], record)
+		}
+	}
+	if len(streams) == 0 {
+		return errors.New("capture has no received bytes")
+	}
+	for port, stream := range streams {
+		decoder := protocol.NewFrameDecoder(stream)
+		decoded := 0
+		mismatched := 0
+		for {
+			frame, err := decoder.Next()
+			if err != nil {
+				break
+			}
+			if decoded >= len(expected[port]) || !recordedFrame(&expected[port][decoded], frame) {
+				fmt.Printf("%s: frame %d is not recorded: version=%d chip=%d type=%02x data=%x\n",
+					port, decoded, frame.Version, frame.ChipID, frame.Type, frame.Data)
+				mismatched++
+			}
+			decoded++
+		}
+		stats := decoder.Stats()
+		fmt.Printf("%s: %d/%d frames, %d mismatched, %d dropped bytes, %d bad checksums, %d bad frames\n",
+			port, stats.Frames, len(expected[port]), mismatched, stats.DroppedBytes, stats.BadChecksums, stats.BadFrames)
+	}
+	return nil
+}
+
+func recordedFrame(record *CaptureRecord, frame *protocol.Frame) bool {
+	return record.Version == frame.Version && record.ChipID == frame.ChipID && record.Type == frame.Type &&
+		record.Data == hex.EncodeToString(frame.Data)
+}
+
+// replaySimulator sends recorded requests to a simulated board with recorded
+// timing and prints recorded responses next to the simulated ones
+func replaySimulator(records []CaptureRecord) error {
+	channel, err := SerialOpen(fmt.Sprintf("sim://replay?chips=%d&latency=0&job=0", MaxChainLength), 0)
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	var last time.Time
+	for i, record := range records {
+		if record.Dir != CaptureTx {
+			continue
+		}
+		data, err := hex.DecodeString(record.Data)
+		if err != nil {
+			return err
+		}
+
+		// Keep recorded timing between requests
+		if !last.IsZero() {
+			time.Sleep(record.Time.Sub(last))
+		}
+		last = record.Time
+
+		// Find recorded response
+		var response *CaptureRecord
+		for _, r := range records[i+1:] {
+			if r.Dir == CaptureRxBytes {
+				continue
+			}
+			if r.Port != record.Port || r.ChipID != record.ChipID || r.Type != record.Type {
+				continue
+			}
+			if r.Dir == CaptureRx {
+				response = &r
+			}
+			break
+		}
+
+		fmt.Printf("%-12s chip=%-3d > %x\n", record.Port, record.ChipID, data)
+		if response == nil {
+			if err := channel.Write(int(record.ChipID), record.Type, data); err != nil {
+				return err
+			}
+			continue
+		}
+		frame, err := channel.Request(int(record.ChipID), record.Type, data)
+		fmt.Printf("%-12s chip=%-3d < recorded:  %s\n", record.Port, record.ChipID, response.Data)
+		if err != nil {
+			fmt.Printf("%-12s chip=%-3d < simulated: %v\n", record.Port, record.ChipID, err)
+		} else {
+			fmt.Printf("%-12s chip=%-3d < simulated: %x\n", record.Port, record.ChipID, frame.Data)
+		}
+	}
+	return nil
+}
+
+func replayCapture(path string, target string) error {
+	records, err := loadCapture(path)
+	if err != nil {
+		return err
+	}
+	switch target {
+	case "":
+		printCapture(records)
+		return nil
+	case "decoder":
+		return replayDecoder(records)
+	case "sim":
+		return replaySimulator(records)
+	}
+	return fmt.Errorf("unknown replay target: %s", target)
+}
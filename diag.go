@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Diag is a set of commands for bench debugging of a single chip, it talks to
+// the chip directly and prints decoded results:
+//
+//	ai-agent diag -port /dev/ttyO1 -chip 1 pll dump
+//	ai-agent diag -port /dev/ttyO1 -chip 1 raw send 1 0xA2 20
+//
+// Numbers are decimal, 0x prefix is for hex.
+//
+
+const diagUsage = `Usage: ai-agent diag [options] <command>
+
+Commands:
+  info                         query and print chip capabilities
+  pll dump                     print MMCM registers, decoded counters and lock
+  pll get <addr>               read PLL register
+  pll set <addr> <value>       write PLL register and read it back
+  sysmon read [channel]        read all sensors, or one by name or address
+  raw send <chip> <type> <hex> send a frame and print the response
+  job run -vector <file>       run a job from 123 byte hex vector and verify it
+  freq get                     print chip frequency
+  freq set <MHz>               set chip frequency with verification
+
+Options:
+`
+
+type diagContext struct {
+	port       *SerialChannel
+	chip       int
+	iterations uint32
+	timeout    int
+}
+
+type diagCommand func(ctx *diagContext, args []string) error
+
+var diagCommands = map[string]diagCommand{
+	"info":        diagInfo,
+	"pll dump":    diagPllDump,
+	"pll get":     diagPllGet,
+	"pll set":     diagPllSet,
+	"sysmon read": diagSysmonRead,
+	"raw send":    diagRawSend,
+	"job run":     diagJobRun,
+	"freq get":    diagFreqGet,
+	"freq set":    diagFreqSet,
+}
+
+// runDiag parses diag arguments and runs a command
+func runDiag(args []string) error {
+	flags := flag.NewFlagSet("diag", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), diagUsage)
+		flags.PrintDefaults()
+	}
+	portName := flags.String("port", "", "UART port name or URL")
+	chip := flags.Int("chip", 1, "Chip ID")
+	part := flags.String("part", "", "Chip part or family, 7-series if empty")
+	iterations := flags.Int("iterations", 1000000, "Iterations of job run")
+	timeout := flags.Int("timeout", 60, "Job timeout")
+	capture := flags.String("capture", "", "Record UART traffic to JSONL file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	// Commands are one or two words
+	var command diagCommand
+	var name string
+	for words := 2; words >= 1 && command == nil; words-- {
+		if len(args) >= words {
+			name = strings.Join(args[:words], " ")
+			command = diagCommands[name]
+		}
+	}
+	if command == nil {
+		flags.Usage()
+		return fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+	}
+	args = args[len(strings.Fields(name)):]
+
+	if *portName == "" {
+		return errors.New("no port specified")
+	}
+	family := &xilinx.Series7
+	if *part != "" {
+		var err error
+		if family, err = xilinx.FindFamilyByName(*part); err != nil {
+			return err
+		}
+	}
+	if *capture != "" {
+		var err error
+		if activeCapture, err = OpenCapture(*capture); err != nil {
+			return err
+		}
+	}
+	port, err := SerialOpen(*portName, 115200)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	port.SetFamily(*chip, family)
+
+	ctx := &diagContext{port: port, chip: *chip, iterations: uint32(*iterations), timeout: *timeout}
+	return command(ctx, args)
+}
+
+func diagArgs(args []string, count int, usage string) error {
+	if len(args) != count {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func parseDiagUint(s string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return v, nil
+}
+
+//
+// Commands
+//
+
+func diagInfo(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 0, "info"); err != nil {
+		return err
+	}
+	caps, err := ctx.port.QueryCapabilities(ctx.chip)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("chip     %d\n", ctx.chip)
+	fmt.Printf("family   %v\n", ctx.port.Family(ctx.chip))
+	fmt.Printf("version  %d\n", caps.Version)
+	fmt.Printf("coin     %d\n", caps.CoinID)
+	fmt.Printf("cores    %d\n", caps.Cores)
+	fmt.Printf("prefixes %d\n", caps.Prefixes)
+	fmt.Printf("features %08x\n", caps.Features)
+	return nil
+}
+
+func diagPllDump(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 0, "pll dump"); err != nil {
+		return err
+	}
+	prop := ctx.port.Family(ctx.chip)
+
+	// Lock status is only known to bitstreams that report it
+	if _, err := ctx.port.QueryCapabilities(ctx.chip); err != nil {
+		return err
+	}
+	power, err := ctx.port.PllGet(ctx.chip, prop.PLLPowerAddr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %02x = %04x\n", "power", prop.PLLPowerAddr, power)
+
+	values := make(map[uint8]uint16)
+	for _, c := range prop.ReadRegisters() {
+		value, err := ctx.port.PllGet(ctx.chip, c.Addr)
+		if err != nil {
+			return err
+		}
+		values[c.Addr] = value
+		fmt.Printf("%-10s %02x = %04x\n", c.Name, c.Addr, value)
+	}
+
+	config, err := xilinx.DecodeMmcm(prop, values)
+	if err != nil {
+		fmt.Printf("mmcm       %v\n", err)
+	} else {
+		fmt.Printf("mmcm       %v vco=%.3f MHz frequency=%.3f MHz\n", config, config.Vco(prop.InputFrequency), config.Frequency(prop.InputFrequency))
+	}
+	if !ctx.port.Capabilities(ctx.chip).Supports(protocol.FeaturePllLock) {
+		fmt.Printf("lock       not reported\n")
+		return nil
+	}
+	locked, err := ctx.port.PllLocked(ctx.chip)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("lock       %v\n", locked)
+	return nil
+}
+
+func diagPllGet(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 1, "pll get <addr>"); err != nil {
+		return err
+	}
+	addr, err := parseDiagUint(args[0], 8)
+	if err != nil {
+		return err
+	}
+	value, err := ctx.port.PllGet(ctx.chip, uint8(addr))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%02x = %04x\n", addr, value)
+	return nil
+}
+
+func diagPllSet(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 2, "pll set <addr> <value>"); err != nil {
+		return err
+	}
+	addr, err := parseDiagUint(args[0], 8)
+	if err != nil {
+		return err
+	}
+	value, err := parseDiagUint(args[1], 16)
+	if err != nil {
+		return err
+	}
+	if err := ctx.port.PllSet(ctx.chip, uint8(addr), uint16(value)); err != nil {
+		return err
+	}
+	readback, err := ctx.port.PllGet(ctx.chip, uint8(addr))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%02x = %04x\n", addr, readback)
+	if readback != uint16(value) {
+		return fmt.Errorf("register %02x reads %04x instead of %04x", addr, readback, value)
+	}
+	return nil
+}
+
+func diagSysmonRead(ctx *diagContext, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: sysmon read [channel]")
+	}
+	prop := ctx.port.Family(ctx.chip)
+
+	// All sensors
+	if len(args) == 0 {
+		status, err := ctx.port.ReadSysmon(ctx.chip)
+		if err != nil {
+			return err
+		}
+		for _, r := range status.Readings {
+			fmt.Printf("%-12s %8.3f %s  min %8.3f  max %8.3f\n", r.Sensor.Name, r.Value, r.Sensor.Unit(), r.Min, r.Max)
+		}
+		fmt.Printf("%-12s %04x %v\n", "alarms", uint16(status.Flags), status.Flags)
+		return nil
+	}
+
+	// Sensor by name, flags or raw address
+	if sensor := xilinx.FindSensor(args[0]); sensor != nil {
+		raw, err := ctx.port.SysmonRead(ctx.chip, sensor.Addr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %02x = %04x (%.3f %s)\n", sensor.Name, sensor.Addr, raw, prop.SysmonValue(sensor, raw), sensor.Unit())
+		return nil
+	}
+	if args[0] == "flags" || args[0] == "alarms" {
+		flags, err := ctx.port.SysmonAlarms(ctx.chip)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("flags %02x = %04x (%v)\n", xilinx.SysmonFlags, uint16(flags), flags)
+		return nil
+	}
+	addr, err := parseDiagUint(args[0], 8)
+	if err != nil {
+		return fmt.Errorf("unknown channel %s", args[0])
+	}
+	raw, err := ctx.port.SysmonRead(ctx.chip, uint8(addr))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%02x = %04x\n", addr, raw)
+	return nil
+}
+
+func diagRawSend(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 3, "raw send <chip> <type> <hex>"); err != nil {
+		return err
+	}
+	chip, err := parseDiagUint(args[0], 8)
+	if err != nil {
+		return err
+	}
+	reqType, err := parseDiagUint(args[1], 8)
+	if err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(args[2], " ", ""))
+	if err != nil || len(data) == 0 {
+		return fmt.Errorf("invalid frame data %s", args[2])
+	}
+	fmt.Printf("tx chip=%d type=%02x %x\n   %s\n", chip, reqType, data, describeFrame(CaptureTx, uint8(reqType), 0, data))
+	frame, err := ctx.port.Request(int(chip), uint8(reqType), data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rx chip=%d type=%02x version=%d %x\n   %s\n", frame.ChipID, frame.Type, frame.Version, frame.Data,
+		describeFrame(CaptureRx, frame.Type, data[0], frame.Data))
+	return nil
+}
+
+func diagJobRun(ctx *diagContext, args []string) error {
+	flags := flag.NewFlagSet("job run", flag.ContinueOnError)
+	vector := flags.String("vector", "", "File with 123 byte block in hex")
+	verbose := flags.Bool("verbose", false, "Log job details")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *vector == "" || flags.NArg() != 0 {
+		return errors.New("usage: job run -vector <file> [-verbose]")
+	}
+	text, err := ioutil.ReadFile(*vector)
+	if err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		return fmt.Errorf("invalid vector %s: %v", *vector, err)
+	}
+	if len(data) != 123 {
+		return fmt.Errorf("invalid vector length, expected 123 bytes, got %d", len(data))
+	}
+
+	if _, err := ctx.port.QueryCapabilities(ctx.chip); err != nil {
+		return err
+	}
+	start := time.Now()
+	results, err := performJob(context.Background(), ctx.port, data, ctx.iterations, nil, ctx.timeout, 0, ctx.chip, *verbose)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("no result")
+	}
+	result := results[0]
+	hashes := hashesPerJob(ctx.port, ctx.chip, int(ctx.iterations))
+	fmt.Printf("value    %x\n", result.Value)
+	fmt.Printf("random   %x\n", result.Random)
+	fmt.Printf("expires  %d\n", result.Expires)
+	fmt.Printf("elapsed  %v, %.0f H/s\n", elapsed, float64(hashes)/elapsed.Seconds())
+	return nil
+}
+
+func diagFreqGet(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 0, "freq get"); err != nil {
+		return err
+	}
+	frequency, err := ctx.port.GetFrequency(ctx.chip)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d MHz\n", frequency)
+	return nil
+}
+
+func diagFreqSet(ctx *diagContext, args []string) error {
+	if err := diagArgs(args, 1, "freq set <MHz>"); err != nil {
+		return err
+	}
+	frequency, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid frequency %s", args[0])
+	}
+
+	// Lock is only verified when chip reports it
+	if _, err := ctx.port.QueryCapabilities(ctx.chip); err != nil {
+		return err
+	}
+	if err := ctx.port.SetFrequency(ctx.chip, frequency); err != nil {
+		return err
+	}
+	return diagFreqGet(ctx, nil)
+}
+
+// diagMain runs diag command line and exits
+func diagMain(args []string) {
+	if err := runDiag(args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
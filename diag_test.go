@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+)
+
+const diagSimPort = "sim://board?chips=1&latency=1ms&job=10ms"
+
+// diagOutput runs a diag command against a simulated chip and returns what
+// it printed
+func diagOutput(t *testing.T, args ...string) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	err = runDiag(append([]string{"-port", diagSimPort}, args...))
+	os.Stdout = stdout
+	writer.Close()
+	res := <-output
+	reader.Close()
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return res
+}
+
+func expectOutput(t *testing.T, output string, expected ...string) {
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected %q in output:\n%s", line, output)
+		}
+	}
+}
+
+func TestDiagPll(t *testing.T) {
+
+	// Divider of 100 MHz setup simulator starts with
+	expectOutput(t, diagOutput(t, "pll", "get", "0x16"), "16 = 2083\n")
+
+	// Written value is read back
+	expectOutput(t, diagOutput(t, "pll", "set", "0x28", "0x1234"), "28 = 1234\n")
+	expectOutput(t, diagOutput(t, "pll", "dump"), "power      28 = ", "lock       true\n")
+}
+
+func TestDiagSysmon(t *testing.T) {
+	expectOutput(t, diagOutput(t, "sysmon", "read"), "temperature ", "vccint ", "vccaux ", "vccbram ", "alarms ")
+	expectOutput(t, diagOutput(t, "sysmon", "read", "temperature"), "temperature 00 = ", " C)\n")
+	expectOutput(t, diagOutput(t, "sysmon", "read", "0x01"), "01 = ")
+}
+
+func TestDiagRawSend(t *testing.T) {
+	expectOutput(t, diagOutput(t, "raw", "send", "1", "0xa2", "21"), "tx chip=1 type=a2 21\n", "rx chip=1 type=a2 version=1 ")
+}
+
+// Diag only reads chip configuration, job events stay as the agent left them
+func TestDiagInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	defer func() {
+		activeCapture.Close()
+		activeCapture = nil
+	}()
+	expectOutput(t, diagOutput(t, "-capture", path, "info"), "chip     1\n", "cores    4\n")
+
+	records, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 {
+		t.Fatal("nothing is captured")
+	}
+	for _, record := range records {
+		if record.Dir == CaptureTx && record.Type == 0xA2 && strings.HasPrefix(record.Data, "23") {
+			t.Fatalf("job events are configured: %+v", record)
+		}
+	}
+
+	// Agent does enable them
+	channel := openSim(t, nil)
+	if _, err := channel.Handshake(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := channel.listeners[frameKey(1, protocol.JobEventType)]; !found {
+		t.Fatal("job events are not enabled by handshake")
+	}
+}
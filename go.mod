@@ -2,13 +2,16 @@ module github.com/ex3ndr/ai-agent
 
 go 1.17
 
+require (
+	github.com/go-cmd/cmd v1.3.1
+	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
+	github.com/sigurn/crc16 v0.0.0-20211026045750-20ab5afb07e3
+)
+
 require (
 	github.com/ShinyTrinkets/meta-logger v0.2.0 // indirect
 	github.com/ShinyTrinkets/overseer v0.4.0 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/go-cmd/cmd v1.3.1 // indirect
-	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4 // indirect
-	github.com/sigurn/crc16 v0.0.0-20211026045750-20ab5afb07e3 // indirect
 	go.bug.st/serial v1.3.3 // indirect
 	golang.org/x/sys v0.0.0-20211020064051-0ec99a608a1b // indirect
 )
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+)
+
+//
+// Job table keeps jobs submitted to every chip of a port. Job IDs are per chip
+// and monotonic, so a result carrying an ID of an earlier job is recognized as
+// superseded and dropped instead of being reported as a fresh one.
+//
+
+// ErrJobLost is returned when chip reports an earlier job as current, so the
+// job being waited for never reached the chip
+var ErrJobLost = errors.New("job lost")
+
+type OutstandingJob struct {
+	ID        uint32
+	Submitted time.Time
+}
+
+type chipJobs struct {
+	lastId      uint32
+	outstanding map[uint32]*OutstandingJob
+}
+
+// JobStats counts results that didn't match the job being waited for and jobs
+// found on chips at startup
+type JobStats struct {
+	Submitted  uint64
+	Completed  uint64
+	Superseded uint64
+	Unknown    uint64
+	Recovered  uint64
+}
+
+// jobMatch classifies job ID reported by chip
+type jobMatch int
+
+const (
+	jobCurrent jobMatch = iota
+	jobSuperseded
+	jobUnknown
+)
+
+func (channel *SerialChannel) chipJobs(chipId int) *chipJobs {
+	jobs, found := channel.jobs[chipId]
+	if !found {
+		jobs = &chipJobs{outstanding: make(map[uint32]*OutstandingJob)}
+		channel.jobs[chipId] = jobs
+	}
+	return jobs
+}
+
+// nextJob allocates ID of a new job of a chip. Chip drops current job once a
+// new one is received, so all outstanding jobs become superseded.
+func (channel *SerialChannel) nextJob(chipId int) uint32 {
+	channel.jobsLock.Lock()
+	defer channel.jobsLock.Unlock()
+	jobs := channel.chipJobs(chipId)
+	jobs.lastId++
+	if jobs.lastId == 0 {
+		jobs.lastId++
+	}
+	for id := range jobs.outstanding {
+		delete(jobs.outstanding, id)
+	}
+	jobs.outstanding[jobs.lastId] = &OutstandingJob{ID: jobs.lastId, Submitted: time.Now()}
+	channel.jobStats.Submitted++
+	return jobs.lastId
+}
+
+// finishJob removes job from outstanding ones: it is completed or host is no
+// longer waiting for it
+func (channel *SerialChannel) finishJob(chipId int, jobId uint32, completed bool) {
+	channel.jobsLock.Lock()
+	defer channel.jobsLock.Unlock()
+	delete(channel.chipJobs(chipId).outstanding, jobId)
+	if completed {
+		channel.jobStats.Completed++
+	}
+}
+
+// matchJob checks job ID reported by chip against the awaited one, mismatches
+// are logged and counted
+func (channel *SerialChannel) matchJob(chipId int, receivedJobId uint32, jobId uint32) jobMatch {
+	if receivedJobId == jobId {
+		return jobCurrent
+	}
+	channel.jobsLock.Lock()
+	defer channel.jobsLock.Unlock()
+	jobs := channel.chipJobs(chipId)
+
+	// IDs are compared with wrap around in mind
+	if receivedJobId != 0 && int32(jobs.lastId-receivedJobId) > 0 {
+		channel.jobStats.Superseded++
+		log.Printf("[%v] Dropped result of superseded job %d from chip %d, waiting for %d", channel.Tag, receivedJobId, chipId, jobId)
+		return jobSuperseded
+	}
+	channel.jobStats.Unknown++
+	log.Printf("[%v] Dropped result of unknown job %d from chip %d, waiting for %d", channel.Tag, receivedJobId, chipId, jobId)
+	return jobUnknown
+}
+
+// OutstandingJobs returns jobs submitted to a chip that are not finished yet
+func (channel *SerialChannel) OutstandingJobs(chipId int) []OutstandingJob {
+	channel.jobsLock.Lock()
+	defer channel.jobsLock.Unlock()
+	res := make([]OutstandingJob, 0)
+	for _, job := range channel.chipJobs(chipId).outstanding {
+		res = append(res, *job)
+	}
+	return res
+}
+
+func (channel *SerialChannel) JobStats() JobStats {
+	channel.jobsLock.Lock()
+	defer channel.jobsLock.Unlock()
+	return channel.jobStats
+}
+
+// Reconcile brings chip job state in line with the table after restart: chip
+// could still be working on a job of a previous process or hold its result.
+// Such result is discarded, running job is aborted when reset is requested and
+// job IDs continue after the one found so leftovers are never taken as fresh.
+func (channel *SerialChannel) Reconcile(chipId int, reset bool) error {
+	res, err := channel.Request(chipId, 0x0, []byte{0x9a})
+	if err != nil {
+		return err
+	}
+	if len(res.Data) == 0 {
+		return errors.New("invalid frame")
+	}
+	if res.Data[0] == protocol.JobStateIdle {
+		return nil
+	}
+	jobState, leftoverId, _, err := parseJobStatus(res.Data)
+	if err != nil {
+		return err
+	}
+
+	channel.jobsLock.Lock()
+	jobs := channel.chipJobs(chipId)
+	if int32(leftoverId-jobs.lastId) > 0 {
+		jobs.lastId = leftoverId
+	}
+	channel.jobStats.Recovered++
+	channel.jobsLock.Unlock()
+
+	switch {
+	case jobState == protocol.JobStateReady:
+		log.Printf("[%v] Discarded result of job %d left on chip %d", channel.Tag, leftoverId, chipId)
+	case reset:
+		log.Printf("[%v] Aborting job %d left running on chip %d", channel.Tag, leftoverId, chipId)
+		return channel.AbortJob(chipId)
+	default:
+		log.Printf("[%v] Job %d left running on chip %d, it is dropped on next submit", channel.Tag, leftoverId, chipId)
+	}
+	return nil
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -15,11 +14,16 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/work"
+	"github.com/ex3ndr/ai-agent/xilinx"
 	"github.com/go-cmd/cmd"
 )
 
@@ -28,12 +32,18 @@ import (
 //
 
 const NonceSize = 8
-const IterationsMultiplier = 1 * 4 // 4 cores per chip
+const IterationsMultiplier = 1 * 4 // 4 cores per chip, when bitstream does not report own count
+const MaxJobResults = 8            // Results reported by a chip for a job with target
+
+// DefaultShareTarget is the highest hash accepted by pool when it doesn't send
+// own target: four zero bytes and the fifth one not above 0x0f
+var DefaultShareTarget = append([]byte{0x00, 0x00, 0x00, 0x00, 0x0f}, bytes.Repeat([]byte{0xff}, 27)...)
 
 type Config struct {
 	Key    string
 	Header []byte
 	Seed   []byte
+	Target []byte
 }
 
 var client = &http.Client{Timeout: 10 * time.Second}
@@ -42,6 +52,7 @@ type ApiConfig struct {
 	Key    string `json:"key"`
 	Header string `json:"header"`
 	Seed   string `json:"seed"`
+	Target string `json:"target,omitempty"`
 }
 
 func loadConfig() (config *Config, err error) {
@@ -69,9 +80,81 @@ func loadConfig() (config *Config, err error) {
 	r.Key = res.Key
 	r.Header = header
 	r.Seed = seed
+
+	// Target is optional, 256 bit big endian number
+	if res.Target != "" {
+		target, err := base64.StdEncoding.DecodeString(res.Target)
+		if err != nil {
+			return nil, err
+		}
+		if len(target) != 32 {
+			return nil, fmt.Errorf("invalid target length: %d", len(target))
+		}
+		r.Target = target
+	}
 	return &r, nil
 }
 
+// ShareTarget returns target sent by pool or the default one
+func (config *Config) ShareTarget() []byte {
+	if config.Target == nil {
+		return DefaultShareTarget
+	}
+	return config.Target
+}
+
+func sameConfig(a *Config, b *Config) bool {
+	return a.Key == b.Key && bytes.Equal(a.Header, b.Header) && bytes.Equal(a.Seed, b.Seed) && bytes.Equal(a.Target, b.Target)
+}
+
+// ConfigSource holds the latest pool config and notifies workers when it is
+// replaced so they could drop jobs built from the old one
+type ConfigSource struct {
+	lock    sync.Mutex
+	config  Config
+	changed chan struct{}
+}
+
+func NewConfigSource(config Config) *ConfigSource {
+	return &ConfigSource{config: config, changed: make(chan struct{})}
+}
+
+// Latest returns current config and a channel that is closed once it changes
+func (source *ConfigSource) Latest() (Config, <-chan struct{}) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return source.config, source.changed
+}
+
+func (source *ConfigSource) IsLatest(config *Config) bool {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return sameConfig(config, &source.config)
+}
+
+// Update replaces config, workers are notified only if it is different
+func (source *ConfigSource) Update(config Config) bool {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if sameConfig(&config, &source.config) {
+		return false
+	}
+	source.config = config
+	close(source.changed)
+	source.changed = make(chan struct{})
+	return true
+}
+
+// refreshConfig polls pool for a new config forever
+func refreshConfig(source *ConfigSource) {
+	for {
+		if source.Update(loadConfigRetry()) {
+			log.Println("Config changed, aborting current jobs")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
 func loadConfigRetry() Config {
 	for {
 		c, e := loadConfig()
@@ -139,235 +222,136 @@ func reportAsync(device string, key string, random []byte, seed []byte, value []
 	})()
 }
 
-func getDigest(d digest) []byte {
-	var res = make([]byte, 32)
-	binary.BigEndian.PutUint32(res[0:], d.h[0])
-	binary.BigEndian.PutUint32(res[4:], d.h[1])
-	binary.BigEndian.PutUint32(res[8:], d.h[2])
-	binary.BigEndian.PutUint32(res[12:], d.h[3])
-	binary.BigEndian.PutUint32(res[16:], d.h[4])
-	binary.BigEndian.PutUint32(res[20:], d.h[5])
-	binary.BigEndian.PutUint32(res[24:], d.h[6])
-	binary.BigEndian.PutUint32(res[28:], d.h[7])
-	return res
-}
-
-type JobResult struct {
-	Expires uint32
-	Random  []byte
-	Value   []byte
-}
-
-func performJob(port *SerialChannel, data []byte, iterations uint32, timeout int, board int, chip int, doLogging bool) (*JobResult, error) {
-
-	// Hash prefix
-	expiresData := data[7:11]
-	expires := binary.BigEndian.Uint32(expiresData)
-	prefix1 := append([]byte(nil), data[:64]...)
-	prefix2 := append([]byte(nil), data[:64]...)
-	prefix3 := append([]byte(nil), data[:64]...)
-	prefix4 := append([]byte(nil), data[:64]...)
-	binary.BigEndian.PutUint32(prefix2[7:11], expires-1)
-	binary.BigEndian.PutUint32(prefix3[7:11], expires-2)
-	binary.BigEndian.PutUint32(prefix4[7:11], expires-3)
-
-	dg := &digest{}
-	dg.h[0] = init0
-	dg.h[1] = init1
-	dg.h[2] = init2
-	dg.h[3] = init3
-	dg.h[4] = init4
-	dg.h[5] = init5
-	dg.h[6] = init6
-	dg.h[7] = init7
-	blockGeneric(dg, prefix1)
-	dgst1 := getDigest(*dg)
-
-	dg = &digest{}
-	dg.h[0] = init0
-	dg.h[1] = init1
-	dg.h[2] = init2
-	dg.h[3] = init3
-	dg.h[4] = init4
-	dg.h[5] = init5
-	dg.h[6] = init6
-	dg.h[7] = init7
-	blockGeneric(dg, prefix2)
-	dgst2 := getDigest(*dg)
-
-	dg = &digest{}
-	dg.h[0] = init0
-	dg.h[1] = init1
-	dg.h[2] = init2
-	dg.h[3] = init3
-	dg.h[4] = init4
-	dg.h[5] = init5
-	dg.h[6] = init6
-	dg.h[7] = init7
-	blockGeneric(dg, prefix3)
-	dgst3 := getDigest(*dg)
-
-	dg = &digest{}
-	dg.h[0] = init0
-	dg.h[1] = init1
-	dg.h[2] = init2
-	dg.h[3] = init3
-	dg.h[4] = init4
-	dg.h[5] = init5
-	dg.h[6] = init6
-	dg.h[7] = init7
-	blockGeneric(dg, prefix4)
-	dgst4 := getDigest(*dg)
+// PreparedJob is a job payload for a chip together with the job it was built
+// from, which verifies results
+type PreparedJob struct {
+	Config  Config
+	Changed <-chan struct{}
+	Command uint8
+	Payload []byte
+	Work    *work.Job
+}
 
-	if doLogging {
-		log.Printf("[%2d] H          : %x,%x,%x,%x\n", board, dgst1, dgst2, dgst3, dgst4)
+// prepareJob builds a job for a chip, chip reports all hashes under target when
+// target is set and only the minimum one otherwise
+func prepareJob(data []byte, iterations uint32, prefixCount int, target []byte, board int, doLogging bool) (*PreparedJob, error) {
+	job, err := work.FromData(data, prefixCount, iterations)
+	if err != nil {
+		return nil, err
 	}
-
-	// Suffix
-	suffix := data[64:]
-	random := suffix[27:]
-	suffix = append(suffix, 0x80, 0x00, 0x00, 0x00, 0x00)
-
-	// Calculate job
-	job := []byte{}
-	job = append(job, dgst1...)
-	job = append(job, dgst2...)
-	job = append(job, dgst3...)
-	job = append(job, dgst4...)
-	job = append(job, suffix...)
-	tmp := make([]byte, 4)
-	binary.BigEndian.PutUint32(tmp, iterations)
-	job = append(job, tmp...)
+	command := uint8(protocol.JobSubmit)
+	if target != nil {
+		command = protocol.JobSubmitTarget
+		job.Target = target
+		job.MaxResults = MaxJobResults
+	}
+	payload := job.Payload()
 
 	// Display job
 	if doLogging {
-		log.Printf("[%2d] Data       : %x\n", board, suffix)
-		log.Printf("[%2d] Random     : %x\n", board, random)
+		log.Printf("[%2d] H          : %x\n", board, payload[:len(job.Midstates)*32])
+		log.Printf("[%2d] Data       : %x\n", board, job.Suffix)
+		log.Printf("[%2d] Random     : %x\n", board, job.Random)
 		log.Printf("[%2d] Iterations : %d\n", board, iterations)
-		log.Printf("[%2d] Job        : %x\n", board, job)
+		log.Printf("[%2d] Job        : %x\n", board, payload)
 	}
 
-	// Send to port if needed
-	if port != nil {
-		start := time.Now()
-		jobResponse, err := port.PerformJob(chip, job, timeout)
-		if err != nil {
-			return nil, err
-		}
-		if len(jobResponse) == 0 {
-			log.Printf("Unable to get response\n")
-			return nil, nil
-		} else {
-			if doLogging {
-				log.Printf("[%2d] Job completed in %v", board, time.Since(start))
-			}
-
-			// Prepare Data
-			hash := jobResponse[0:32]
-			nonce := jobResponse[32 : 32+4]
-			prefixIdRaw := jobResponse[32+4 : 32+4+4]
-			prefixId := binary.BigEndian.Uint32(prefixIdRaw)
-			xored := append([]byte(nil), suffix...)
-			nrandom := append([]byte(nil), random...)
-			index := nonce[len(nonce)-1] - suffix[len(nonce)-1]
-			for i := 0; i < len(nonce); i++ {
-				xored[i] = nonce[i]
-				xored[i+48] = nonce[i]
-				nrandom[i+21] = nonce[i]
-			}
+	return &PreparedJob{Command: command, Payload: payload, Work: job}, nil
+}
 
-			// TODO:L
-			resExpires := expires
-			prefix := prefix1
-			if prefixId == 1 {
-				prefix = prefix2
-				resExpires = resExpires - 1
-			}
-			if prefixId == 2 {
-				prefix = prefix3
-				resExpires = resExpires - 2
-			}
-			if prefixId == 3 {
-				prefix = prefix4
-				resExpires = resExpires - 3
-			}
+// verifyJob checks raw chip response against locally calculated hashes. Jobs
+// with target have a number of results, the ones that passed are returned even
+// if others failed.
+func verifyJob(job *PreparedJob, jobResponse []byte, board int, doLogging bool) ([]*work.Share, error) {
+	shares, err := job.Work.VerifyAll(jobResponse)
+	if doLogging {
+		log.Printf("[%2d] RAW          : %x", board, jobResponse)
+		for _, share := range shares {
+			log.Printf("[%2d] PREFIX ID    : %d", board, share.Prefix)
+			log.Printf("[%2d] NONCE        : %08x", board, share.Nonce)
+			log.Printf("[%2d] HASH         : %x", board, share.Value)
+			log.Printf("[%2d] RANDOM       : %x", board, share.Random)
+		}
+	}
+	return shares, err
+}
 
-			// Check hash
-			sh := sha256.New()
-			sh.Write(prefix)
-			sh.Write(xored[:64-5])
-			localHash := sh.Sum(nil)
-
-			// Print results
-			if doLogging {
-				log.Printf("[%2d] PREFIX ID    : %d", board, prefixId)
-				log.Printf("[%2d] RAW          : %x", board, jobResponse)
-				log.Printf("[%2d] DATA         : %x", board, suffix)
-				log.Printf("[%2d] PREPARED DATA: %x", board, xored)
-				// log.Printf("[%2d] RANDOM       : %x", board, nrandom)
-				log.Printf("[%2d] FPGA LLD     : %d", board, index)
-				log.Printf("[%2d] FPGA NONCE   : %x", board, nonce)
-				log.Printf("[%2d] FPGA HASH    : %x", board, hash)
-				log.Printf("[%2d] LOCAL HASH   : %x", board, localHash)
-			}
+// cpuThreads is the number of threads of CPU-based miner, all cores if zero
+var cpuThreads = 0
 
-			// Check hash
-			if !bytes.Equal(hash, localHash) {
-				return nil, fmt.Errorf("hash mismatch. Expected %x, but got %x", localHash, hash)
-			}
+// cpuStats is hashrate of CPU-based miner since the last report
+var cpuStats struct {
+	sync.Mutex
+	jobs    int
+	hashes  int64
+	elapsed time.Duration
+}
 
-			return &JobResult{Random: nrandom, Value: localHash, Expires: resExpires}, nil
-		}
-	} else {
+// addCpuJob reports hashrate of CPU-based miner every PipelineStatsInterval jobs
+func addCpuJob(board int, hashes int64, elapsed time.Duration) {
+	cpuStats.Lock()
+	defer cpuStats.Unlock()
+	cpuStats.jobs++
+	cpuStats.hashes += hashes
+	cpuStats.elapsed += elapsed
+	if cpuStats.jobs%PipelineStatsInterval == 0 {
+		log.Printf("[%2d] CPU: %d jobs, %.0f H/s on %d threads\n", board, cpuStats.jobs,
+			float64(cpuStats.hashes)/cpuStats.elapsed.Seconds(), cpuThreads)
+		cpuStats.hashes = 0
+		cpuStats.elapsed = 0
+	}
+}
 
-		//
-		// CPU-based miner
-		//
-
-		min := make([]byte, 32)
-		minNonce := make([]byte, 4)
-		for i := 0; i < int(iterations); i++ {
-
-			// Create nonce
-			nonce := make([]byte, 4)
-			binary.BigEndian.PutUint32(nonce, uint32(i))
-			xored := append([]byte(nil), suffix...)
-			for i := 0; i < len(nonce); i++ {
-				xored[i] = nonce[i]
-				xored[i+48] = nonce[i]
-			}
+// performJob runs a job on a chip, or on CPU when there is no port. Every hash
+// under target is returned when target is set and chip supports it, only the
+// minimum one otherwise.
+func performJob(ctx context.Context, port *SerialChannel, data []byte, iterations uint32, target []byte, timeout int, board int, chip int, doLogging bool) ([]*work.Share, error) {
 
-			// Calculate hash
-			sh := sha256.New()
-			sh.Write(data)
-			sh.Write(xored[:64-5])
-			localHash := sh.Sum(nil)
-
-			// Update minimum
-			if i == 0 {
-				min = localHash
-				minNonce = nonce
-			} else {
-				if bytes.Compare(localHash, min) < 0 {
-					min = localHash
-					minNonce = nonce
-				}
-			}
+	// Number of prefixes supported by chip
+	prefixCount := DefaultCapabilities.Prefixes
+	if port != nil {
+		caps := port.Capabilities(chip)
+		prefixCount = caps.Prefixes
+		if !caps.Supports(protocol.FeatureJobTarget) {
+			target = nil
 		}
+	}
+	job, err := prepareJob(data, iterations, prefixCount, target, board, doLogging)
+	if err != nil {
+		return nil, err
+	}
 
-		nrandom := append([]byte(nil), random...)
-		for i := 0; i < len(minNonce); i++ {
-			nrandom[i+21] = minNonce[i]
+	// Send to port if needed, CPU-based miner reports results the same way
+	start := time.Now()
+	var jobResponse []byte
+	if port != nil {
+		jobResponse, err = port.PerformJob(ctx, chip, job.Command, job.Payload, timeout)
+	} else {
+		jobResponse, err = job.Work.Search(ctx, cpuThreads)
+		if err == context.Canceled {
+			err = ErrJobAborted
 		}
-
-		log.Printf("CPU RANDOM : %x", nrandom)
-		log.Printf("CPU NONCE  : %x", minNonce)
-		log.Printf("CPU HASH   : %x", min)
-
-		return &JobResult{Random: nrandom, Value: min}, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	if len(jobResponse) == 0 {
+		log.Printf("Unable to get response\n")
+		return nil, nil
+	}
+	elapsed := time.Since(start)
+	if doLogging {
+		log.Printf("[%2d] Job completed in %v", board, elapsed)
+	}
+	if port == nil {
+		addCpuJob(board, hashesPerJob(nil, chip, int(iterations)), elapsed)
+	}
+	return verifyJob(job, jobResponse, board, doLogging)
 }
 
+// BitstreamDir is where bitstreams are uploaded from
+const BitstreamDir = "/monad/imperium/software/work/"
+
 func uploadBitstream(name string) {
 	// Disable output buffering, enable streaming
 	cmdOptions := cmd.Options{
@@ -376,7 +360,7 @@ func uploadBitstream(name string) {
 	}
 
 	// Create Cmd with options
-	envCmd := cmd.NewCmdOptions(cmdOptions, "/monad/imperium/software/utility", "upload", "/monad/imperium/software/work/"+name)
+	envCmd := cmd.NewCmdOptions(cmdOptions, "/monad/imperium/software/utility", "upload", BitstreamDir+name)
 	envCmd.Dir = "/monad/imperium/software/"
 
 	// Print STDOUT and STDERR lines streaming from Cmd
@@ -447,20 +431,53 @@ type Stats struct {
 	Hashrate     int64
 	Mined        int64
 	Mutex        sync.Mutex
-	Temperatures [][]float32
+	Temperatures map[string]float32
+	Events       []ThermalEventBody
+	Sysmon       map[string]*SysmonStatus
+	Jobs         map[string][]OutstandingJob
 }
 
 type StatsBody struct {
-	Id           string            `json:"id"`
-	Name         string            `json:"name"`
-	Datacenter   string            `json:"dc"`
-	Hashrate     float64           `json:"hashrate"`
-	Temperatures []TemperatureBody `json:"temperature"`
+	Id           string             `json:"id"`
+	Name         string             `json:"name"`
+	Datacenter   string             `json:"dc"`
+	Hashrate     float64            `json:"hashrate"`
+	Temperatures []TemperatureBody  `json:"temperature"`
+	Events       []ThermalEventBody `json:"events,omitempty"`
+	Sysmon       []SysmonBody       `json:"sysmon,omitempty"`
+	Jobs         []JobsBody         `json:"jobs,omitempty"`
 }
 type TemperatureBody struct {
 	Id    string  `json:"id"`
 	Value float32 `json:"value"`
 }
+type SysmonBody struct {
+	Id      string       `json:"id"`
+	Sensors []SensorBody `json:"sensors"`
+	Alarms  []string     `json:"alarms"`
+}
+type SensorBody struct {
+	Name  string  `json:"name"`
+	Value float32 `json:"value"`
+	Min   float32 `json:"min"`
+	Max   float32 `json:"max"`
+}
+type JobsBody struct {
+	Id          string          `json:"id"`
+	Outstanding []JobStatusBody `json:"outstanding"`
+}
+type JobStatusBody struct {
+	Id  uint32  `json:"id"`
+	Age float64 `json:"age"`
+}
+type ThermalEventBody struct {
+	Id          string  `json:"id"`
+	State       string  `json:"state"`
+	Temperature float32 `json:"temperature"`
+	Frequency   int     `json:"frequency"`
+	Time        int64   `json:"time"`
+	Error       string  `json:"error,omitempty"`
+}
 
 func doStatsReport(data StatsBody) error {
 	// Encode report
@@ -517,49 +534,173 @@ func startStatsReporting(stats *Stats) {
 	for {
 		stats.Mutex.Lock()
 		temperatures := make([]TemperatureBody, 0)
-		for board := 0; board < 3; board++ {
-			for chip := 0; chip < 6; chip++ {
-				temperatures = append(temperatures, TemperatureBody{
-					Id:    fmt.Sprintf("chip_%d_%d", board, chip),
-					Value: stats.Temperatures[board][chip],
-				})
+		for id, value := range stats.Temperatures {
+			temperatures = append(temperatures, TemperatureBody{
+				Id:    id,
+				Value: value,
+			})
+		}
+		sort.Slice(temperatures, func(i, j int) bool { return temperatures[i].Id < temperatures[j].Id })
+		sysmon := make([]SysmonBody, 0)
+		for id, status := range stats.Sysmon {
+			body := SysmonBody{Id: id, Sensors: make([]SensorBody, 0), Alarms: status.Flags.Alarms()}
+			for _, r := range status.Readings {
+				body.Sensors = append(body.Sensors, SensorBody{Name: r.Sensor.Name, Value: r.Value, Min: r.Min, Max: r.Max})
+			}
+			sysmon = append(sysmon, body)
+		}
+		sort.Slice(sysmon, func(i, j int) bool { return sysmon[i].Id < sysmon[j].Id })
+		jobs := make([]JobsBody, 0)
+		for id, outstanding := range stats.Jobs {
+			body := JobsBody{Id: id, Outstanding: make([]JobStatusBody, 0)}
+			for _, job := range outstanding {
+				body.Outstanding = append(body.Outstanding, JobStatusBody{Id: job.ID, Age: time.Since(job.Submitted).Seconds()})
 			}
+			jobs = append(jobs, body)
 		}
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
 		data := StatsBody{
 			Id:           stats.Id,
 			Name:         stats.Name,
 			Datacenter:   stats.Datacenter,
 			Hashrate:     float64(stats.Hashrate) / 1000000000,
 			Temperatures: temperatures,
+			Events:       stats.Events,
+			Sysmon:       sysmon,
+			Jobs:         jobs,
 		}
+		stats.Events = nil
 		stats.Mutex.Unlock()
 		doStatsReport(data)
 		time.Sleep(15 * time.Second)
 	}
 }
 
+// hashesPerJob is the number of hashes calculated by a job, every core of a chip
+// runs all iterations with own prefix, CPU-based miner runs all prefixes
+func hashesPerJob(port *SerialChannel, chip int, iterations int) int64 {
+	if port == nil {
+		return int64(iterations) * int64(DefaultCapabilities.Prefixes)
+	}
+	return int64(iterations) * int64(port.Capabilities(chip).Cores)
+}
+
+func applyTemperature(stats *Stats, id string, value float32) {
+	stats.Mutex.Lock()
+	stats.Temperatures[id] = value
+	stats.Mutex.Unlock()
+}
+
+func applySysmon(stats *Stats, id string, status *SysmonStatus) {
+	stats.Mutex.Lock()
+	stats.Sysmon[id] = status
+	stats.Mutex.Unlock()
+}
+
+func applyJobs(stats *Stats, id string, outstanding []OutstandingJob) {
+	stats.Mutex.Lock()
+	stats.Jobs[id] = outstanding
+	stats.Mutex.Unlock()
+}
+
+func applyThermalEvent(stats *Stats, id string, event ThermalEvent) {
+	body := ThermalEventBody{
+		Id:          id,
+		State:       event.State.String(),
+		Temperature: event.Temperature,
+		Frequency:   event.Frequency,
+		Time:        event.Time.Unix(),
+	}
+	if event.Err != nil {
+		body.Error = event.Err.Error()
+	}
+	stats.Mutex.Lock()
+	stats.Events = append(stats.Events, body)
+	stats.Mutex.Unlock()
+}
+
 func applyMined(stats *Stats, count int64) {
 	stats.Mutex.Lock()
 	stats.Mined += count
 	stats.Mutex.Unlock()
 }
 
+// chipFamily selects family by part given in arguments or by bitstream header,
+// 7-series is assumed if neither is known
+func chipFamily(part string, bitstream string) *xilinx.Family {
+	if part != "" {
+		family, err := xilinx.FindFamilyByName(part)
+		if err != nil {
+			log.Panicln(err)
+		}
+		return family
+	}
+	if bitstream == "" {
+		return &xilinx.Series7
+	}
+	family, header, err := BitstreamFamily(bitstream)
+	if err != nil {
+		log.Printf("Unable to detect chip family, assuming %v: %v", &xilinx.Series7, err)
+		return &xilinx.Series7
+	}
+	log.Printf("Bitstream %s is built for %s, %v family", header.Design, header.Part, family)
+	return family
+}
+
 func main() {
 
+	// Bench commands have own arguments
+	if len(os.Args) > 1 && os.Args[1] == "diag" {
+		diagMain(os.Args[2:])
+		return
+	}
+
 	var err error
 
 	// Arguments
-	portName := flag.String("port", "", "UART port name")
+	portName := flag.String("port", "", "UART port name or URL (serial:///dev/ttyO1?baud=115200, tcp://host:port, unix:///path)")
 	iterations := flag.Int("iterations", 1000000, "iterations count")
 	config := flag.String("config", "", "Custom config")
 	timeout := flag.Int("timeout", 5, "job timeout")
+	threads := flag.Int("threads", 0, "CPU threads used without COM port, all cores if zero")
 	test := flag.Bool("test", false, "Use test serial debug")
 	env := flag.String("dc", "dev", "DC ID")
 	supervised := flag.Bool("supervised", false, "Supervised invironment")
 	chip := flag.Int("chip", 6, "Working Chip ID")
 	bitstream := flag.String("bitstream", "ai.bit", "Bitstream to use")
+	rig := flag.String("rig", DefaultRigPorts, "Comma separated ports probed in supervised mode, position is the board index. Patterns like /dev/ttyO[1-9] are expanded")
+	maxChip := flag.Int("max-chip", DefaultMaxChip, "Max chip ID probed on every board in supervised mode")
+	chain := flag.Bool("chain", false, "Boards are daisy chains, assign chip addresses on startup")
+	resetJobs := flag.Bool("reset-jobs", true, "Abort jobs left running on chips by a previous run")
+	profiles := flag.String("profiles", "profiles.json", "Tuned chip frequencies, applied on startup in supervised mode")
+	autotune := flag.Bool("autotune", false, "Tune frequency of chips without a stored profile in supervised mode")
+	throttleTemp := flag.Float64("throttle-temp", DefaultThrottleTemperature, "Step chip frequency down above this temperature in supervised mode")
+	pauseTemp := flag.Float64("pause-temp", DefaultPauseTemperature, "Stop submitting jobs to a chip above this temperature in supervised mode")
+	criticalTemp := flag.Float64("critical-temp", DefaultCriticalTemperature, "Stop chip clock above this temperature in supervised mode")
+	thermalHysteresis := flag.Float64("thermal-hysteresis", DefaultThermalHysteresis, "Degrees a chip should cool down by to leave a thermal state")
+	part := flag.String("part", "", "Chip part or family (7series), read from bitstream in supervised mode if empty")
+	capture := flag.String("capture", "", "Record UART traffic to JSONL file")
+	replay := flag.String("replay", "", "Print UART capture file and exit")
+	replayTarget := flag.String("replay-target", "", "Replay capture against \"decoder\" or \"sim\" instead of printing")
 	flag.Parse()
 
+	// Replay
+	if replay != nil && *replay != "" {
+		if err := replayCapture(*replay, *replayTarget); err != nil {
+			log.Panicln(err)
+		}
+		return
+	}
+
+	// Capture
+	if capture != nil && *capture != "" {
+		activeCapture, err = OpenCapture(*capture)
+		if err != nil {
+			log.Panicln(err)
+		}
+		log.Printf("Capturing UART traffic to %s", *capture)
+	}
+
 	// Resolve Device ID and Name
 	id := getMacAddr()
 	if err != nil {
@@ -571,7 +712,7 @@ func main() {
 	log.Printf("Started device " + deviceName + "(" + id + ")")
 
 	// Stats
-	stats := Stats{Hashrate: 0, Id: id, Name: deviceName, Datacenter: *env, Temperatures: [][]float32{{0, 0, 0, 0, 0, 0}, {0, 0, 0, 0, 0, 0}, {0, 0, 0, 0, 0, 0}}}
+	stats := Stats{Hashrate: 0, Id: id, Name: deviceName, Datacenter: *env, Temperatures: make(map[string]float32), Sysmon: make(map[string]*SysmonStatus), Jobs: make(map[string][]OutstandingJob)}
 
 	// Test
 	if test != nil && *test {
@@ -673,14 +814,10 @@ func main() {
 			time.Sleep(1 * time.Second)
 
 			// Temp
-			pp.Write(*chip, 0x00, []byte{0x7c, 0x0e, 0x00, 0x00, 0x00})
-			frame, err := pp.Read()
+			temp, err := pp.GetTemperature(*chip)
 			if err != nil {
 				log.Panicln(err)
 			}
-			log.Printf("Frame from %d: %x \n", frame.ChipID, frame.Data)
-			x := float32(binary.BigEndian.Uint16(frame.Data[1:]))
-			temp := x*502.9098/65536 - 273.819
 			log.Printf("Temperature %f", temp)
 
 			// Status
@@ -718,21 +855,6 @@ func main() {
 		// Start Leds
 		StartLed()
 
-		// Define Ports
-		ports := []string{
-			"/dev/ttyO1",
-			"/dev/ttyO2",
-			"/dev/ttyO5",
-		}
-		chips := []int{
-			1,
-			2,
-			3,
-			4,
-			5,
-			6,
-		}
-
 		// Uploading
 		// SetGreenLed(true, true) // It seems that uploadBitstream enables green led blinking anyway
 		SetRedLed(false, false)
@@ -742,16 +864,11 @@ func main() {
 
 		// Loading config
 		log.Println("Loading initial config...")
-		lastestConfig := loadConfigRetry()
+		configs := NewConfigSource(loadConfigRetry())
 
 		// Start config refetch loop
 		log.Println("Starting config refresh...")
-		go (func() {
-			for {
-				lastestConfig = loadConfigRetry()
-				time.Sleep(5 * time.Second)
-			}
-		})()
+		go refreshConfig(configs)
 
 		// Config
 		defaultIterations := 800000000
@@ -759,25 +876,97 @@ func main() {
 		iterations := &defaultIterations
 		timeout := &defaultTimeout
 
-		for index := range ports {
-			boardId := index
-			go (func() {
-				log.Printf("[%2d] Connecting to board\n", boardId)
-				port, err := SerialOpen(ports[boardId], 115200)
-				if err != nil {
-					log.Panicln(err)
-				}
-
-				log.Printf("[%2d] Starting threads\n", boardId)
-				var latestQuery uint32 = 0
-				for chipIndex := range chips {
-					chipId := chips[chipIndex]
+		// Discover rig
+		log.Println("Discovering boards...")
+		family := chipFamily(*part, BitstreamDir+*bitstream)
+		topology := DiscoverTopology(ResolvePorts(*rig), *maxChip, *chain, *resetJobs, family)
+		if topology.ChipCount() == 0 {
+			SetRedLed(true, false)
+			SetGreenLed(false, false)
+			log.Panicln("No chips found")
+		}
+		log.Printf("Found %d chips: %v\n", topology.ChipCount(), topology)
 
-					// Jobs
-					go (func() {
-					outer:
+		// Frequencies
+		store, err := LoadProfiles(*profiles)
+		if err != nil {
+			log.Panicln(err)
+		}
+		bitstreamId := bitstreamID(BitstreamDir + *bitstream)
+		var tuning sync.WaitGroup
+		for _, b := range topology.Boards {
+			if applyChainProfile(store, b, bitstreamId) {
+				continue
+			}
+			for _, c := range b.Chips {
+				board := b
+				chip := c
+				tuning.Add(1)
+				go func() {
+					defer tuning.Done()
+					applyProfile(store, board, chip, bitstreamId, *autotune)
+				}()
+			}
+		}
+		tuning.Wait()
+
+		// Thermal limits
+		policy := DefaultThermalPolicy
+		policy.Throttle = float32(*throttleTemp)
+		policy.Pause = float32(*pauseTemp)
+		policy.Critical = float32(*criticalTemp)
+		policy.Hysteresis = float32(*thermalHysteresis)
+		governors := make([]*ThermalGovernor, 0)
+
+		for _, b := range topology.Boards {
+			board := b
+			port := board.Channel
+			boardId := board.Index
+
+			log.Printf("[%2d] Starting threads\n", boardId)
+			var latestQuery uint32 = 0
+			for _, c := range board.Chips {
+				chip := c
+				chipId := chip.ID
+
+				// Temperature
+				governor := NewThermalGovernor(port, boardId, chipId, policy)
+				governor.OnTemperature = func(temperature float32) {
+					applyTemperature(&stats, board.TemperatureID(chip), temperature)
+					applyJobs(&stats, board.TemperatureID(chip), port.OutstandingJobs(chipId))
+				}
+				governor.OnEvent = func(event ThermalEvent) {
+					applyThermalEvent(&stats, board.TemperatureID(chip), event)
+				}
+				governors = append(governors, governor)
+				go governor.Run()
+
+				// Supplies and alarms
+				go func() {
+					for {
+						status, err := port.ReadSysmon(chipId)
+						if err != nil {
+							log.Printf("[%2d] %v\n", boardId, err)
+							delayRetry()
+							continue
+						}
+						if status.Flags != 0 {
+							log.Printf("[%2d] Chip %d: sysmon alarms %v\n", boardId, chipId, status.Flags)
+						}
+						applySysmon(&stats, board.TemperatureID(chip), status)
+						time.Sleep(SysmonInterval)
+					}
+				}()
+
+				// Jobs
+				pipeline := &JobPipeline{
+					Port:    port,
+					Board:   boardId,
+					ChipID:  chipId,
+					Timeout: *timeout,
+					Prepare: func() *PreparedJob {
 						for {
-							config := lastestConfig
+							config, changed := configs.Latest()
 							queryId := atomic.AddUint32(&latestQuery, 1)
 							log.Printf("[%2d] Attempt    : %d\n", boardId, queryId)
 
@@ -785,69 +974,89 @@ func main() {
 							random := make([]byte, 32)
 							rand.Read(random)
 
-							// Create block
-							data := make([]byte, 0)
-							data = append(data, config.Header...)
-							data = append(data, random...)
-							data = append(data, config.Seed...)
-							data = append(data, random...)
+							// Prepare job
+							// Let chip report every share when it could
+							caps := port.Capabilities(chipId)
+							var target []byte
+							if caps.Supports(protocol.FeatureJobTarget) {
+								target = config.ShareTarget()
+							}
 
-							// Do Job
-							result, err := performJob(port, data, uint32(*iterations), *timeout, boardId, chipId, false)
+							// Wait for a new config if this one can't be turned into a job
+							job, err := prepareJob(work.Data(config.Header, random, config.Seed), uint32(*iterations), caps.Prefixes, target, boardId, false)
 							if err != nil {
-								log.Printf("[%2d] %v\n", boardId, err)
-								delayRetry()
-								continue
-							}
-							if result == nil {
-								log.Printf("Unable to get results")
+								log.Printf("[%2d] Chip %d: %v\n", boardId, chipId, err)
 								delayRetry()
 								continue
 							}
+							job.Config = config
+							job.Changed = changed
+							return job
+						}
+					},
+					Valid: func(job *PreparedJob) bool {
+						return configs.IsLatest(&job.Config)
+					},
+					Handle: func(job *PreparedJob, results []*work.Share, err error) {
+						if err == ErrJobAborted {
+							log.Printf("[%2d] Chip %d: job aborted, config changed\n", boardId, chipId)
+							return
+						}
 
-							// Apply stats
-							applyMined(&stats, int64(*iterations)*IterationsMultiplier)
-
-							// Check if not enough zeros
-							for i := 0; i < 4; i++ {
-								if result.Value[i] != 0 {
-									continue outer
-								}
-							}
-							if result.Value[4] > 0x0f {
-								continue outer
+						// Some of results could still be valid
+						if err != nil {
+							log.Printf("[%2d] %v\n", boardId, err)
+							if len(results) == 0 {
+								return
 							}
-
-							// Report
-							reportAsync(deviceName, config.Key, result.Random, config.Seed, result.Value, result.Expires)
 						}
-					})()
+						if results == nil {
+							log.Printf("Unable to get results")
+							return
+						}
 
-					// Monitoring
-					go func() {
-						for {
+						// Apply stats
+						applyMined(&stats, hashesPerJob(port, chipId, *iterations))
 
-							// Collect temperature
-							v, err := port.GetTemperature(chipId)
-							if err != nil {
-								log.Printf("[%2d] %v\n", boardId, err)
-								delayRetry()
+						// Never report results of an old config
+						if !configs.IsLatest(&job.Config) {
+							log.Printf("[%2d] Chip %d: dropped result of stale config\n", boardId, chipId)
+							return
+						}
+
+						// Report every share
+						for _, result := range results {
+							if !work.IsShare(result.Value, job.Config.ShareTarget()) {
 								continue
 							}
-							stats.Temperatures[boardId][chipId-1] = v
-
-							// Delay
-							delayRetry()
+							reportAsync(deviceName, job.Config.Key, result.Random, job.Config.Seed, result.Value, result.Expires)
 						}
-					}()
+					},
+					Governor: governor,
 				}
-			})()
+				go pipeline.Run()
+			}
 		}
 
 		go (func() {
 			time.Sleep(20 * time.Second)
 
 			for {
+				// Overheated chips are signalled first: solid red when a
+				// chip is stopped, blinking red when it is held back
+				switch WorstThermalState(governors) {
+				case ThermalStopped:
+					SetRedLed(true, false)
+					SetGreenLed(false, false)
+					delayRetry()
+					continue
+				case ThermalPaused, ThermalThrottled:
+					SetRedLed(true, true)
+					SetGreenLed(true, false)
+					delayRetry()
+					continue
+				}
+
 				// Monitor hashrate
 				if stats.Hashrate < 1000 {
 					SetRedLed(true, true)
@@ -874,8 +1083,22 @@ func main() {
 		if err != nil {
 			log.Panicln(err)
 		}
+		port.SetFamily(*chip, chipFamily(*part, ""))
+		caps, err := port.Handshake(*chip)
+		if err != nil {
+			log.Printf("Handshake with chip %d failed, using defaults: %v", *chip, err)
+			caps = port.Capabilities(*chip)
+		}
+		log.Printf("Chip %d: %v", *chip, caps)
+		if err := port.Reconcile(*chip, *resetJobs); err != nil {
+			log.Printf("Unable to recover job state of chip %d: %v", *chip, err)
+		}
 	} else {
-		log.Println("Running without COM port")
+		cpuThreads = *threads
+		if cpuThreads <= 0 {
+			cpuThreads = runtime.NumCPU()
+		}
+		log.Printf("Running without COM port, mining on %d CPU threads", cpuThreads)
 	}
 
 	// Debug mode
@@ -906,11 +1129,11 @@ func main() {
 				log.Printf("Attempt    : %d\n", queryId)
 
 				// Do Job
-				result, err := performJob(port, data, uint32(*iterations), *timeout, 0, *chip, true)
+				results, err := performJob(context.Background(), port, data, uint32(*iterations), nil, *timeout, 0, *chip, true)
 				if err != nil {
 					log.Panicln(err)
 				}
-				if result == nil {
+				if results == nil {
 					log.Printf("Unable to get results")
 				}
 			}
@@ -922,23 +1145,18 @@ func main() {
 
 		// Loading config
 		log.Println("Loading initial config...")
-		lastestConfig := loadConfigRetry()
+		configs := NewConfigSource(loadConfigRetry())
 
 		// Start config refetch loop
 		log.Println("Starting config refresh...")
-		go (func() {
-			for {
-				lastestConfig = loadConfigRetry()
-				time.Sleep(5 * time.Second)
-			}
-		})()
+		go refreshConfig(configs)
 
 		// Start threads
 		log.Println("Starting threads...")
 		var latestQuery uint32 = 0
 		go (func() {
 			for {
-				config := lastestConfig
+				config, changed := configs.Latest()
 				queryId := atomic.AddUint32(&latestQuery, 1)
 				log.Printf("Attempt    : %d\n", queryId)
 
@@ -947,28 +1165,41 @@ func main() {
 				rand.Read(random)
 
 				// Create block
-				data := make([]byte, 0)
-				data = append(data, config.Header...)
-				data = append(data, random...)
-				data = append(data, config.Seed...)
-				data = append(data, random...)
+				data := work.Data(config.Header, random, config.Seed)
 
-				// Do Job
-				result, err := performJob(port, data, uint32(*iterations), *timeout, 0, *chip, true)
+				// Do Job, cancelled when config changes
+				ctx, cancel := abortContext(changed)
+				results, err := performJob(ctx, port, data, uint32(*iterations), config.ShareTarget(), *timeout, 0, *chip, true)
+				cancel()
+
+				// Some of results could still be valid. Failed job is retried
+				// after a delay like in pipeline, a config that can't be turned
+				// into a job fails at once.
 				if err != nil {
 					log.Println(err)
-					continue
+					if len(results) == 0 {
+						if err != ErrJobAborted {
+							delayRetry()
+						}
+						continue
+					}
 				}
 
 				// Process
-				if result == nil {
+				if results == nil {
 					log.Printf("Unable to get results")
+				} else if !configs.IsLatest(&config) {
+					log.Printf("Dropped result of stale config")
 				} else {
 					// Apply stats
-					applyMined(&stats, int64(*iterations)*IterationsMultiplier)
+					applyMined(&stats, hashesPerJob(port, *chip, *iterations))
 
-					// Report
-					reportAsync(deviceName, config.Key, result.Random, config.Seed, result.Value, result.Expires)
+					// Report every share
+					for _, result := range results {
+						if work.IsShare(result.Value, config.ShareTarget()) {
+							reportAsync(deviceName, config.Key, result.Random, config.Seed, result.Value, result.Expires)
+						}
+					}
 				}
 			}
 		})()
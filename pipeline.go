@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/work"
+)
+
+//
+// JobPipeline keeps a chip busy: the next job is staged while the current one
+// is running and submitted as soon as the current one is reported done, and
+// results are verified and reported from a separate goroutine. Running job is
+// aborted as soon as its config is replaced. Submission is held while thermal
+// governor pauses the chip.
+//
+
+// PipelineStatsInterval is the number of jobs between utilization reports
+const PipelineStatsInterval = 50
+
+type JobPipeline struct {
+	Port    *SerialChannel
+	Board   int
+	ChipID  int
+	Timeout int
+
+	// Prepare builds a new job, Valid reports if a staged job could still be
+	// submitted, Handle receives results in order of completion
+	Prepare func() *PreparedJob
+	Valid   func(job *PreparedJob) bool
+	Handle  func(job *PreparedJob, results []*work.Share, err error)
+
+	// Governor holds submission while chip is too hot, optional
+	Governor *ThermalGovernor
+
+	statsLock sync.Mutex
+	stats     PipelineStats
+}
+
+// PipelineStats measures how much time chip spends without a job, idle is the
+// time between result of a job is received and the next job is submitted
+type PipelineStats struct {
+	Jobs int64
+	Busy time.Duration
+	Idle time.Duration
+}
+
+func (stats PipelineStats) Utilization() float64 {
+	total := stats.Busy + stats.Idle
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Busy) / float64(total)
+}
+
+type completedJob struct {
+	job      *PreparedJob
+	response []byte
+	err      error
+}
+
+func (pipeline *JobPipeline) Stats() PipelineStats {
+	pipeline.statsLock.Lock()
+	defer pipeline.statsLock.Unlock()
+	return pipeline.stats
+}
+
+// Run drives the chip forever
+func (pipeline *JobPipeline) Run() {
+	completed := make(chan completedJob, 16)
+	go pipeline.verify(completed)
+
+	current := pipeline.Prepare()
+	var finished time.Time
+	for {
+
+		// Wait for chip to cool down, staged job could be outdated by then
+		if pipeline.Governor != nil && pipeline.Governor.Wait() {
+			finished = time.Time{}
+			if !pipeline.Valid(current) {
+				current = pipeline.Prepare()
+			}
+		}
+
+		// Submit
+		submitted := time.Now()
+		jobId, err := pipeline.Port.SubmitJob(pipeline.ChipID, current.Command, current.Payload)
+		if err != nil {
+			completed <- completedJob{job: current, err: err}
+			delayRetry()
+			current = pipeline.Prepare()
+			finished = time.Time{}
+			continue
+		}
+		if !finished.IsZero() {
+			pipeline.addIdle(submitted.Sub(finished))
+		}
+
+		// Stage next job while chip is working
+		next := pipeline.Prepare()
+
+		// Wait for result
+		ctx, cancel := abortContext(current.Changed)
+		response, err := pipeline.Port.WaitJob(ctx, pipeline.ChipID, jobId, pipeline.Timeout)
+		cancel()
+		finished = time.Now()
+		pipeline.addBusy(finished.Sub(submitted))
+		completed <- completedJob{job: current, response: response, err: err}
+		if err != nil && err != ErrJobAborted {
+			delayRetry()
+			finished = time.Time{}
+		}
+
+		// Staged job could be built from outdated config
+		if !pipeline.Valid(next) {
+			next = pipeline.Prepare()
+		}
+		current = next
+	}
+}
+
+// abortContext is cancelled when changed channel is closed
+func abortContext(changed <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if changed != nil {
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+func (pipeline *JobPipeline) verify(completed chan completedJob) {
+	for c := range completed {
+		if c.err != nil {
+			pipeline.Handle(c.job, nil, c.err)
+			continue
+		}
+		if len(c.response) == 0 {
+			pipeline.Handle(c.job, nil, nil)
+			continue
+		}
+		results, err := verifyJob(c.job, c.response, pipeline.Board, false)
+		pipeline.Handle(c.job, results, err)
+	}
+}
+
+func (pipeline *JobPipeline) addBusy(duration time.Duration) {
+	pipeline.statsLock.Lock()
+	defer pipeline.statsLock.Unlock()
+	pipeline.stats.Jobs++
+	pipeline.stats.Busy += duration
+	if pipeline.stats.Jobs%PipelineStatsInterval == 0 {
+		jobStats := pipeline.Port.JobStats()
+		log.Printf("[%2d] Chip %d: %d jobs, utilization %.2f%%, idle %v per job, port dropped %d superseded and %d unknown results\n",
+			pipeline.Board, pipeline.ChipID, pipeline.stats.Jobs, pipeline.stats.Utilization()*100,
+			pipeline.stats.Idle/time.Duration(pipeline.stats.Jobs), jobStats.Superseded, jobStats.Unknown)
+	}
+}
+
+func (pipeline *JobPipeline) addIdle(duration time.Duration) {
+	pipeline.statsLock.Lock()
+	defer pipeline.statsLock.Unlock()
+	pipeline.stats.Idle += duration
+}
@@ -0,0 +1,65 @@
+package protocol
+
+//
+// Commands are the first byte of frame data. Frames of type 0x00 are jobs and
+// sysmon access, frames of type 0xA2 are PLL access, chip info and chain
+// addressing. Responses carry chip ID and type of the request.
+//
+
+const (
+	UnassignedChipID = 0x00
+	BroadcastChipID  = 0xFF
+	ChainAssign      = 0x30
+	ChainReset       = 0x31
+)
+
+const (
+	JobStateIdle    = 0
+	JobStateWorking = 1
+	JobStateReady   = 2
+
+	// JobSubmit is a job reporting minimum hash, JobSubmitTarget carries
+	// target and maximum number of results after the iterations
+	JobSubmit       = 0x8c
+	JobSubmitTarget = 0x8d
+
+	// JobAbort stops current job of a chip
+	JobAbort = 0x6d
+
+	// JobEventType is a frame type of job completion pushed by chip
+	JobEventType = 0xE0
+)
+
+const (
+	PllWrite = 0x0A
+	PllRead  = 0x0B
+	PllLock  = 0x0C
+)
+
+const (
+	ChipInfoCoinID      = 0x20
+	ChipInfoCores       = 0x21
+	ChipInfoFeatures    = 0x22
+	ChipConfigJobEvents = 0x23
+)
+
+// Features reported by bitstream
+const (
+	// FeatureJobEvents chip pushes job completion instead of waiting for status check
+	FeatureJobEvents uint32 = 1 << 0
+	// FeatureJobAbort chip could drop current job without submitting a new one
+	FeatureJobAbort uint32 = 1 << 1
+	// FeatureJobTarget chip accepts target with a job and reports every nonce
+	// under it instead of the minimum only
+	FeatureJobTarget uint32 = 1 << 2
+	// FeaturePllLock chip reports MMCM lock status
+	FeaturePllLock uint32 = 1 << 3
+)
+
+// Sysmon request is operation, DRP address and value for writes, response
+// echoes the command and holds a 16 bit register value
+const (
+	SysmonCommand = 0x7c
+	SysmonRead    = 0x0e
+	SysmonWrite   = 0x0f
+)
@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+const (
+	decoderBufferSize = 4096
+	// MaxFrameLength is the longest unescaped frame: header, 16-bit length payload and checksum
+	MaxFrameLength = PacketHeaderLength + 0xFFFF + PacketChecksumLength
+)
+
+// DecoderStats are counters of a stream that was not decoded into valid frames
+type DecoderStats struct {
+	Frames       uint64
+	DroppedBytes uint64
+	BadChecksums uint64
+	BadFrames    uint64
+}
+
+// FrameDecoder reads framed packets from a byte stream. Garbage between frames,
+// truncated and corrupted frames are skipped and the decoder resynchronizes on
+// the next STX, so a valid frame is never lost because of a preceding bad one.
+type FrameDecoder struct {
+	// Counters go first to keep them 64-bit aligned on ARM
+	frames       uint64
+	droppedBytes uint64
+	badChecksums uint64
+	badFrames    uint64
+
+	reader  io.Reader
+	buffer  []byte
+	pos     int
+	end     int
+	pending []byte
+	frame   bytes.Buffer
+	raw     bytes.Buffer
+	inFrame bool
+	escaped bool
+}
+
+func NewFrameDecoder(reader io.Reader) *FrameDecoder {
+	return &FrameDecoder{reader: reader, buffer: make([]byte, decoderBufferSize)}
+}
+
+// Next returns the next valid frame from the stream. Only errors of the
+// underlying reader are returned, invalid frames are counted and skipped.
+func (decoder *FrameDecoder) Next() (*Frame, error) {
+	for {
+		b, err := decoder.nextByte()
+		if err != nil {
+			return nil, err
+		}
+
+		// Outside of a frame everything but STX is garbage
+		if !decoder.inFrame {
+			if b == STX {
+				decoder.startFrame()
+			} else {
+				atomic.AddUint64(&decoder.droppedBytes, 1)
+			}
+			continue
+		}
+		decoder.raw.WriteByte(b)
+
+		// Escaped byte
+		if decoder.escaped {
+			decoder.escaped = false
+			decoder.writeByte(b)
+			continue
+		}
+
+		switch b {
+		case STX:
+			// Frame was truncated, start over from this STX
+			atomic.AddUint64(&decoder.droppedBytes, uint64(decoder.raw.Len()-1))
+			decoder.startFrame()
+		case ESC:
+			decoder.escaped = true
+		case ETX:
+			frame := decoder.finishFrame()
+			if frame != nil {
+				return frame, nil
+			}
+		default:
+			decoder.writeByte(b)
+		}
+	}
+}
+
+// Stats returns counters of the decoder, safe to call concurrently with Next
+func (decoder *FrameDecoder) Stats() DecoderStats {
+	return DecoderStats{
+		Frames:       atomic.LoadUint64(&decoder.frames),
+		DroppedBytes: atomic.LoadUint64(&decoder.droppedBytes),
+		BadChecksums: atomic.LoadUint64(&decoder.badChecksums),
+		BadFrames:    atomic.LoadUint64(&decoder.badFrames),
+	}
+}
+
+func (decoder *FrameDecoder) nextByte() (byte, error) {
+
+	// Bytes of a rejected frame are replayed first
+	if len(decoder.pending) > 0 {
+		b := decoder.pending[0]
+		decoder.pending = decoder.pending[1:]
+		return b, nil
+	}
+
+	// Refill buffer
+	for decoder.pos == decoder.end {
+		n, err := decoder.reader.Read(decoder.buffer)
+		if n > 0 {
+			decoder.pos = 0
+			decoder.end = n
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	b := decoder.buffer[decoder.pos]
+	decoder.pos++
+	return b, nil
+}
+
+func (decoder *FrameDecoder) startFrame() {
+	decoder.frame.Reset()
+	decoder.raw.Reset()
+	decoder.raw.WriteByte(STX)
+	decoder.inFrame = true
+	decoder.escaped = false
+}
+
+func (decoder *FrameDecoder) writeByte(b byte) {
+	if decoder.frame.Len() >= MaxFrameLength {
+		decoder.dropFrame()
+		return
+	}
+	decoder.frame.WriteByte(b)
+}
+
+// dropFrame rejects current frame. STX inside of a rejected frame could be
+// the start of a valid frame that was escaped or swallowed by the corrupted
+// one, so decoding is restarted from it.
+func (decoder *FrameDecoder) dropFrame() {
+	raw := decoder.raw.Bytes()
+	dropped := len(raw)
+	if index := bytes.IndexByte(raw[1:], STX); index >= 0 {
+		dropped = index + 1
+		decoder.pending = append(append([]byte(nil), raw[dropped:]...), decoder.pending...)
+	}
+	atomic.AddUint64(&decoder.droppedBytes, uint64(dropped))
+	decoder.frame.Reset()
+	decoder.raw.Reset()
+	decoder.inFrame = false
+	decoder.escaped = false
+}
+
+func (decoder *FrameDecoder) finishFrame() *Frame {
+	data := decoder.frame.Bytes()
+
+	// Check checksum
+	payload, err := popCRC(data)
+	if err != nil {
+		atomic.AddUint64(&decoder.badChecksums, 1)
+		decoder.dropFrame()
+		return nil
+	}
+
+	// Parse packet
+	frame, err := parsePacket(payload)
+	if err != nil {
+		atomic.AddUint64(&decoder.badFrames, 1)
+		decoder.dropFrame()
+		return nil
+	}
+
+	// Frame data is still referencing decoder buffer
+	frame.Data = append([]byte(nil), frame.Data...)
+	atomic.AddUint64(&decoder.frames, 1)
+	decoder.frame.Reset()
+	decoder.raw.Reset()
+	decoder.inFrame = false
+	return frame
+}
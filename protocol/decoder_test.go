@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// decodeAll reads frames until the end of the stream
+func decodeAll(t *testing.T, reader io.Reader) ([]*Frame, DecoderStats) {
+	decoder := NewFrameDecoder(reader)
+	frames := make([]*Frame, 0)
+	for {
+		frame, err := decoder.Next()
+		if err == io.EOF {
+			return frames, decoder.Stats()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestFrameDecoder(t *testing.T) {
+	first := PackVersion(1, 3, 0xA2, []byte{0x20, 0x00, 0x01})
+	second := PackVersion(1, 4, 0x00, []byte{0x02, 0x1b, 0x03, 0x9a})
+	firstFrame := &Frame{Version: 1, ChipID: 3, Type: 0xA2, Data: []byte{0x20, 0x00, 0x01}}
+	secondFrame := &Frame{Version: 1, ChipID: 4, Type: 0x00, Data: []byte{0x02, 0x1b, 0x03, 0x9a}}
+
+	// Checksum is the last two bytes before ETX, neither of them is escaped
+	badChecksum := append([]byte(nil), first...)
+	badChecksum[len(badChecksum)-2] ^= 0x01
+
+	// Header declares more data than the frame has
+	badLength := concat([]byte{STX}, escape(calcFrame([]byte{0, 0xA2, 3, 0, 5, 1})), []byte{ETX})
+
+	tests := []struct {
+		name   string
+		stream []byte
+		frames []*Frame
+		stats  DecoderStats
+	}{
+		{
+			name:   "frames",
+			stream: concat(first, second),
+			frames: []*Frame{firstFrame, secondFrame},
+			stats:  DecoderStats{Frames: 2},
+		},
+		{
+			name:   "garbage before STX",
+			stream: concat([]byte{0xff, 0x03, 0x1b, 0x00}, second),
+			frames: []*Frame{secondFrame},
+			stats:  DecoderStats{Frames: 1, DroppedBytes: 4},
+		},
+		{
+			name:   "truncated frame",
+			stream: concat(first[:5], second),
+			frames: []*Frame{secondFrame},
+			stats:  DecoderStats{Frames: 1, DroppedBytes: 5},
+		},
+		{
+			name:   "truncated at the end",
+			stream: concat(second, first[:5]),
+			frames: []*Frame{secondFrame},
+			stats:  DecoderStats{Frames: 1},
+		},
+		{
+			name:   "bad checksum followed by a good frame",
+			stream: concat(badChecksum, second),
+			frames: []*Frame{secondFrame},
+			stats:  DecoderStats{Frames: 1, DroppedBytes: uint64(len(badChecksum)), BadChecksums: 1},
+		},
+		{
+			name:   "length mismatch",
+			stream: concat(badLength, second),
+			frames: []*Frame{secondFrame},
+			stats:  DecoderStats{Frames: 1, DroppedBytes: uint64(len(badLength)), BadFrames: 1},
+		},
+		{
+			// ESC at the end of a broken frame swallows STX of the next one
+			name:   "STX inside a rejected frame",
+			stream: concat([]byte{STX, 0x01, ESC}, first, second),
+			frames: []*Frame{firstFrame, secondFrame},
+			stats:  DecoderStats{Frames: 2, DroppedBytes: 3, BadChecksums: 1},
+		},
+	}
+	readers := []struct {
+		name string
+		open func(stream []byte) io.Reader
+	}{
+		{"whole", func(stream []byte) io.Reader { return bytes.NewReader(stream) }},
+		{"byte by byte", func(stream []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) }},
+		{"halves", func(stream []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(stream)) }},
+	}
+	for _, test := range tests {
+		for _, reader := range readers {
+			frames, stats := decodeAll(t, reader.open(test.stream))
+			if !reflect.DeepEqual(frames, test.frames) {
+				t.Errorf("%s, %s: expected frames %+v, got %+v", test.name, reader.name, test.frames, frames)
+			}
+			if stats != test.stats {
+				t.Errorf("%s, %s: expected stats %+v, got %+v", test.name, reader.name, test.stats, stats)
+			}
+		}
+	}
+}
+
+// calcFrame appends checksum to a body
+func calcFrame(body []byte) []byte {
+	return append(append([]byte(nil), body...), calcChecksum(body)...)
+}
+
+func TestFrameDecoderEscapeBoundary(t *testing.T) {
+
+	// Every escaped byte is split from its ESC by a read
+	data := []byte{STX, ETX, ESC, ESC, STX}
+	packed := PackVersion(1, 1, 0x00, data)
+	for split := 1; split < len(packed); split++ {
+		reader := io.MultiReader(bytes.NewReader(packed[:split]), bytes.NewReader(packed[split:]))
+		frames, _ := decodeAll(t, reader)
+		if len(frames) != 1 || !bytes.Equal(frames[0].Data, data) {
+			t.Fatalf("split at %d: unexpected frames %+v", split, frames)
+		}
+	}
+}
+
+// FuzzFrameDecoder checks that any garbage is skipped and a valid frame after
+// it is decoded. Two ETX end any frame the garbage could have started: the
+// first one could be escaped, the second one is not.
+func FuzzFrameDecoder(f *testing.F) {
+	f.Add([]byte{}, uint8(1), uint8(0x00), []byte{0x9a})
+	f.Add([]byte{STX, 0x01, ESC}, uint8(2), uint8(0xA2), []byte{STX, ETX, ESC})
+	f.Add([]byte{STX, ESC}, uint8(STX), uint8(ETX), []byte{})
+	f.Add(PackVersion(1, 3, 0xA2, []byte{0x20}), uint8(ESC), uint8(0xE0), []byte{0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, garbage []byte, chipId uint8, reqType uint8, data []byte) {
+		if len(garbage) > 4096 || len(data) > 4096 {
+			t.Skip()
+		}
+		packed := PackVersion(1, chipId, reqType, data)
+		stream := concat(garbage, []byte{ETX, ETX}, packed)
+		frames, stats := decodeAll(t, iotest.OneByteReader(bytes.NewReader(stream)))
+		if len(frames) == 0 {
+			t.Fatalf("frame is lost after %x", garbage)
+		}
+		if stats.Frames != uint64(len(frames)) {
+			t.Fatalf("expected %d frames in stats, got %d", len(frames), stats.Frames)
+		}
+		last := frames[len(frames)-1]
+		if last.Version != 1 || last.ChipID != chipId || last.Type != reqType || !bytes.Equal(last.Data, data) {
+			t.Fatalf("expected %x, got %+v", packed, last)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sigurn/crc16"
+)
+
+//
+// Frames are STX, escaped body and ETX. Body is a header with protocol
+// version, frame type, chip ID and data length, then data and CRC16/ARC of
+// header and data. STX, ETX and ESC inside of body are prefixed with ESC.
+//
+
+type Frame struct {
+	Version uint8
+	ChipID  uint8
+	Type    uint8
+	Data    []byte
+}
+
+const (
+	STX                  byte = 0x02
+	ETX                  byte = 0x03
+	ESC                  byte = 0x1B
+	PacketHeaderLength        = 5
+	PacketChecksumLength      = 2
+)
+
+func escape(data []byte) []byte {
+	var buf bytes.Buffer
+	for _, b := range data {
+		switch b {
+		case STX:
+			fallthrough
+		case ESC:
+			fallthrough
+		case ETX:
+			buf.WriteByte(ESC)
+			fallthrough
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	return buf.Bytes()
+}
+
+func calcChecksum(data []byte) []byte {
+	arr := make([]byte, 2)
+	table := crc16.MakeTable(crc16.CRC16_ARC)
+	checksum := crc16.Checksum(data, table)
+	binary.BigEndian.PutUint16(arr, checksum)
+	return arr
+}
+
+type packetHeader struct {
+	Version uint8
+	Type    uint8
+	ID      uint8
+	Length  uint16
+}
+
+func Pack(id uint8, requestType uint8, data []byte) []byte {
+	return PackVersion(0, id, requestType, data)
+}
+
+func PackVersion(version uint8, id uint8, requestType uint8, data []byte) []byte {
+
+	// Frame
+	header := packetHeader{
+		Version: version,
+		Type:    requestType,
+		ID:      id,
+		Length:  uint16(len(data)),
+	}
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, &header)
+	payload.Write(data)
+	payload.Write(calcChecksum(payload.Bytes()))
+	body := payload.Bytes()
+	body = escape(body)
+
+	// Transfer package
+	var res bytes.Buffer
+	res.WriteByte(STX)
+	res.Write(body)
+	res.WriteByte(ETX)
+	return res.Bytes()
+}
+
+func parsePacket(p []byte) (*Frame, error) {
+	// check length
+	if len(p) < PacketHeaderLength {
+		return nil, fmt.Errorf("invalid parsing: %x", p)
+	}
+	// parse header
+	hdr := packetHeader{}
+	headerBuf := bytes.NewBuffer(p[:PacketHeaderLength])
+	binary.Read(headerBuf, binary.BigEndian, &hdr)
+	data := p[PacketHeaderLength:]
+	if len(data) != int(hdr.Length) {
+		return nil, fmt.Errorf("invalid parsing: %x", p)
+	}
+	res := Frame{Version: hdr.Version, ChipID: hdr.ID, Type: hdr.Type, Data: data}
+	return &res, nil
+}
+
+func popCRC(p []byte) ([]byte, error) {
+	// check length
+	if len(p) < PacketChecksumLength {
+		return nil, fmt.Errorf("invalid packet: %x", p)
+	}
+	pcrc := len(p) - PacketChecksumLength
+	payload := p[:pcrc]
+	checksum := p[pcrc:]
+	// checksum
+	if !bytes.Equal(checksum, calcChecksum(payload)) {
+		return nil, fmt.Errorf("checksum failed expected %x, got %x. data: %x", calcChecksum(payload), checksum, p)
+	}
+	return payload, nil
+}
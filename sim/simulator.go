@@ -0,0 +1,643 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/work"
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Simulator implements device side of the UART protocol for a board of chips,
+// so agent could be run without a rig. Every answer could be delayed, dropped or
+// corrupted to exercise error handling of the host.
+//
+
+type Options struct {
+	Chips         int
+	Chain         bool
+	HopLatency    time.Duration
+	Version       uint8
+	Cores         int
+	CoinID        uint32
+	Features      uint32
+	Latency       time.Duration
+	JobDuration   time.Duration
+	MaxIterations uint32
+	Temperature   float32
+	Frequency     int
+	MaxFrequency  int
+	LockFrequency int
+	DropRate      float64
+	CorruptRate   float64
+	WrongJobRate  float64
+	HashErrorRate float64
+	Family        *xilinx.Family
+}
+
+var DefaultOptions = Options{
+	Chips:         6,
+	Version:       1,
+	Cores:         4,
+	CoinID:        1,
+	Features:      protocol.FeatureJobEvents | protocol.FeatureJobAbort | protocol.FeatureJobTarget | protocol.FeaturePllLock,
+	Latency:       5 * time.Millisecond,
+	HopLatency:    1 * time.Millisecond,
+	JobDuration:   1 * time.Second,
+	MaxIterations: 1 << 16,
+	Temperature:   45,
+	Frequency:     100,
+	Family:        &xilinx.Series7,
+}
+
+type Simulator struct {
+	options    Options
+	device     net.Conn
+	writeLock  sync.Mutex
+	randomLock sync.Mutex
+	random     *rand.Rand
+	chips      map[uint8]*simulatedChip
+	chain      []*simulatedChip
+}
+
+type simulatedChip struct {
+	lock       sync.Mutex
+	address    uint8
+	position   int
+	state      uint8
+	jobId      uint32
+	generation uint64
+	events     bool
+	result     []byte
+	pll        map[uint8]uint16
+	sysmon     map[uint8]uint16
+}
+
+// New starts simulated board and returns host end of its UART
+func New(options Options) (*Simulator, io.ReadWriteCloser) {
+	host, device := net.Pipe()
+	sim := &Simulator{
+		options: options,
+		device:  device,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		chips:   make(map[uint8]*simulatedChip),
+	}
+	for i := 1; i <= options.Chips; i++ {
+		chip := &simulatedChip{position: i - 1, pll: make(map[uint8]uint16), sysmon: make(map[uint8]uint16)}
+		sim.chain = append(sim.chain, chip)
+
+		// MMCM starts with bitstream defaults
+		if setup, err := options.Family.Setup(options.Frequency); err == nil {
+			for _, cv := range setup {
+				chip.pll[cv.Const.Addr] = cv.Value & ^cv.Const.Mask
+			}
+		}
+
+		// Chained chips wait for address assignment
+		if !options.Chain {
+			chip.address = uint8(i)
+			sim.chips[chip.address] = chip
+		}
+	}
+	go sim.run()
+	return sim, host
+}
+
+func (sim *Simulator) Close() error {
+	return sim.device.Close()
+}
+
+func (sim *Simulator) run() {
+	decoder := protocol.NewFrameDecoder(sim.device)
+	for {
+		frame, err := decoder.Next()
+		if err != nil {
+			return
+		}
+		switch frame.ChipID {
+		case protocol.BroadcastChipID:
+			sim.handleBroadcast(frame)
+		case protocol.UnassignedChipID:
+			sim.handleAssign(frame)
+		default:
+			chip, found := sim.chips[frame.ChipID]
+			if !found {
+				continue
+			}
+			sim.handle(frame, chip)
+		}
+	}
+}
+
+//
+// Chain
+//
+
+func (sim *Simulator) handleBroadcast(frame *protocol.Frame) {
+	if sim.options.Chain && frame.Type == 0xA2 && len(frame.Data) == 1 && frame.Data[0] == protocol.ChainReset {
+		sim.chips = make(map[uint8]*simulatedChip)
+		for _, chip := range sim.chain {
+			chip.lock.Lock()
+			chip.address = protocol.UnassignedChipID
+			chip.lock.Unlock()
+		}
+		return
+	}
+	for _, chip := range sim.chain {
+		if sim.address(chip) != protocol.UnassignedChipID {
+			sim.handle(frame, chip)
+		}
+	}
+}
+
+func (sim *Simulator) handleAssign(frame *protocol.Frame) {
+	if !sim.options.Chain || frame.Type != 0xA2 || len(frame.Data) != 2 || frame.Data[0] != protocol.ChainAssign {
+		return
+	}
+	for _, chip := range sim.chain {
+		if sim.address(chip) == protocol.UnassignedChipID {
+			chip.lock.Lock()
+			chip.address = frame.Data[1]
+			chip.lock.Unlock()
+			sim.chips[frame.Data[1]] = chip
+			return
+		}
+	}
+}
+
+func (sim *Simulator) address(chip *simulatedChip) uint8 {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	return chip.address
+}
+
+func (sim *Simulator) handle(frame *protocol.Frame, chip *simulatedChip) {
+	if len(frame.Data) == 0 {
+		return
+	}
+	switch frame.Type {
+	case 0x00:
+		switch frame.Data[0] {
+		case protocol.JobSubmit:
+			sim.submitJob(chip, frame.Data[1:], false)
+		case protocol.JobSubmitTarget:
+			if sim.options.Features&protocol.FeatureJobTarget != 0 {
+				sim.submitJob(chip, frame.Data[1:], true)
+			}
+		case 0x9a:
+			sim.respond(frame, chip, sim.jobStatus(chip))
+		case protocol.JobAbort:
+			if sim.options.Features&protocol.FeatureJobAbort != 0 {
+				sim.abortJob(chip)
+				sim.respond(frame, chip, []byte{protocol.JobAbort, protocol.JobStateIdle})
+			}
+		case protocol.SysmonCommand:
+			sim.handleSysmon(frame, chip)
+		}
+	case 0xA2:
+		sim.handleInfo(frame, chip)
+	}
+}
+
+func (sim *Simulator) handleInfo(frame *protocol.Frame, chip *simulatedChip) {
+
+	// Legacy bitstreams only support PLL access
+	if sim.options.Version == 0 {
+		sim.handlePll(frame, chip)
+		return
+	}
+
+	resp := make([]byte, 4)
+	switch frame.Data[0] {
+	case protocol.ChipInfoCoinID:
+		binary.BigEndian.PutUint32(resp, sim.options.CoinID)
+	case protocol.ChipInfoCores:
+		resp = []byte{uint8(sim.options.Cores)}
+	case protocol.ChipInfoFeatures:
+		binary.BigEndian.PutUint32(resp, sim.options.Features)
+	case protocol.ChipConfigJobEvents:
+		if len(frame.Data) != 2 || sim.options.Features&protocol.FeatureJobEvents == 0 {
+			return
+		}
+		chip.lock.Lock()
+		chip.events = frame.Data[1] == 1
+		chip.lock.Unlock()
+		resp = []byte{frame.Data[1]}
+	default:
+		sim.handlePll(frame, chip)
+		return
+	}
+	sim.respond(frame, chip, resp)
+}
+
+func (sim *Simulator) handlePll(frame *protocol.Frame, chip *simulatedChip) {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	resp := make([]byte, 2)
+	switch {
+	case frame.Data[0] == protocol.PllRead && len(frame.Data) == 2:
+		binary.BigEndian.PutUint16(resp, chip.pll[frame.Data[1]])
+	case frame.Data[0] == protocol.PllWrite && len(frame.Data) == 4:
+		value := binary.BigEndian.Uint16(frame.Data[2:])
+		chip.pll[frame.Data[1]] = value
+		binary.BigEndian.PutUint16(resp, value)
+	case frame.Data[0] == protocol.PllLock && sim.options.Features&protocol.FeaturePllLock != 0:
+		resp = []byte{0}
+		if sim.locked(chip) {
+			resp[0] = 1
+		}
+	default:
+		return
+	}
+	sim.respond(frame, chip, resp)
+}
+
+//
+// Sysmon
+//
+
+// Supply voltages of a simulated chip
+var simulatedVoltages = map[*xilinx.Sensor]float32{
+	&xilinx.SensorVccInt:  1.0,
+	&xilinx.SensorVccAux:  1.8,
+	&xilinx.SensorVccBram: 1.0,
+}
+
+func (sim *Simulator) handleSysmon(frame *protocol.Frame, chip *simulatedChip) {
+	if len(frame.Data) != 5 {
+		return
+	}
+	temperature := sim.temperature(chip)
+	addr := frame.Data[2]
+	chip.lock.Lock()
+	sim.updateSysmon(chip, temperature)
+	var value uint16
+	switch frame.Data[1] {
+	case protocol.SysmonRead:
+		value = chip.sysmon[addr]
+	case protocol.SysmonWrite:
+		value = binary.BigEndian.Uint16(frame.Data[3:])
+		chip.sysmon[addr] = value
+	default:
+		chip.lock.Unlock()
+		return
+	}
+	chip.lock.Unlock()
+	resp := []byte{protocol.SysmonCommand, 0, 0}
+	binary.BigEndian.PutUint16(resp[1:], value)
+	sim.respond(frame, chip, resp)
+}
+
+// updateSysmon refreshes sensors, min/max trackers and alarm flags. Zero
+// thresholds are treated as disabled. Chip lock should be held.
+func (sim *Simulator) updateSysmon(chip *simulatedChip, temperature float32) {
+	var flags xilinx.SysmonFlag
+	for _, sensor := range xilinx.Sensors {
+		value := temperature
+		if sensor.Kind == xilinx.SensorVoltage {
+			value = simulatedVoltages[sensor]
+		}
+		raw := sim.options.Family.SysmonRaw(sensor, value)
+		chip.sysmon[sensor.Addr] = raw
+		if min := chip.sysmon[sensor.Min]; min == 0 || raw < min {
+			chip.sysmon[sensor.Min] = raw
+		}
+		if raw > chip.sysmon[sensor.Max] {
+			chip.sysmon[sensor.Max] = raw
+		}
+		upper, lower := chip.sysmon[sensor.Upper], chip.sysmon[sensor.Lower]
+		if (upper != 0 && raw > upper) || (lower != 0 && raw < lower) {
+			flags |= sensor.Alarm
+		}
+	}
+	if limit := chip.sysmon[xilinx.SysmonOTLimit]; limit != 0 && chip.sysmon[xilinx.SensorTemp.Addr] >= limit {
+		flags |= xilinx.SysmonOverTemp
+	}
+	chip.sysmon[xilinx.SysmonFlags] = uint16(flags)
+}
+
+//
+// Jobs
+//
+
+func (sim *Simulator) submitJob(chip *simulatedChip, data []byte, withTarget bool) {
+	tail := 0
+	if withTarget {
+		tail = 32 + 1
+	}
+	if len(data) < 4+32+64+4+tail || (len(data)-4-64-4-tail)%32 != 0 {
+		return
+	}
+	chip.lock.Lock()
+	chip.generation++
+	generation := chip.generation
+	chip.state = protocol.JobStateWorking
+	chip.jobId = binary.BigEndian.Uint32(data)
+	chip.result = nil
+	chip.lock.Unlock()
+
+	job := append([]byte(nil), data[4:]...)
+	frequency := sim.frequency(chip)
+
+	// Chip without clock never finishes a job
+	if frequency <= 0 {
+		return
+	}
+	go func() {
+		start := time.Now()
+
+		// Legacy jobs report only the minimum hash
+		var result []byte
+		if withTarget {
+			body := job[:len(job)-tail]
+			target := job[len(job)-tail : len(job)-1]
+			found := sim.computeJob(body, target, int(job[len(job)-1]))
+			result = []byte{uint8(len(found))}
+			for _, r := range found {
+				result = append(result, r...)
+			}
+		} else {
+			result = sim.computeJob(job, nil, 1)[0]
+		}
+		if len(result) >= 40 && sim.chance(sim.hashErrorRate(frequency)) {
+			result[len(result)-40] ^= 0xff
+		}
+		duration := sim.options.JobDuration * time.Duration(sim.options.Frequency) / time.Duration(frequency)
+		time.Sleep(duration - time.Since(start))
+
+		chip.lock.Lock()
+		if chip.generation != generation {
+			chip.lock.Unlock()
+			return
+		}
+		chip.state = protocol.JobStateReady
+		chip.result = result
+		events := chip.events
+		address := chip.address
+		chip.lock.Unlock()
+
+		// Push completion without waiting for status check
+		if events {
+			sim.respond(&protocol.Frame{ChipID: address, Type: protocol.JobEventType}, chip, sim.jobStatus(chip))
+		}
+	}()
+}
+
+func (sim *Simulator) abortJob(chip *simulatedChip) {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	chip.generation++
+	chip.state = protocol.JobStateIdle
+	chip.result = nil
+}
+
+func (sim *Simulator) jobStatus(chip *simulatedChip) []byte {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	if chip.state == protocol.JobStateIdle {
+		return []byte{protocol.JobStateIdle}
+	}
+	jobId := chip.jobId
+	if sim.chance(sim.options.WrongJobRate) {
+		jobId++
+	}
+	resp := []byte{chip.state, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(resp[1:], jobId)
+	if chip.state == protocol.JobStateReady {
+		resp = append(resp, chip.result...)
+	}
+	return resp
+}
+
+// computeJob searches nonces the same way bitstream does: nonce is written to
+// the first and the 48th byte of the last block, and every core hashes it with
+// own prefix midstate. Returns up to maxResults best hashes not above target,
+// or just the minimum when there is no target, each as hash, nonce and prefix
+// index. Simulated chip has a core per prefix of the job.
+func (sim *Simulator) computeJob(job []byte, target []byte, maxResults int) [][]byte {
+	prefixes := (len(job) - 64 - 4) / 32
+	suffix := job[prefixes*32 : prefixes*32+64]
+	iterations := binary.BigEndian.Uint32(job[prefixes*32+64:])
+	if iterations > sim.options.MaxIterations {
+		iterations = sim.options.MaxIterations
+	}
+
+	midstates := make([]work.Digest, prefixes)
+	for p := range midstates {
+		midstates[p] = work.ParseDigest(job[p*32:])
+	}
+
+	block := append([]byte(nil), suffix...)
+	base := binary.BigEndian.Uint32(suffix)
+	res := make([][]byte, 0)
+	for i := uint32(0); i < iterations; i++ {
+		nonce := base + i
+		binary.BigEndian.PutUint32(block[0:], nonce)
+		binary.BigEndian.PutUint32(block[48:], nonce)
+		for p := 0; p < prefixes; p++ {
+			hash := work.Finish(midstates[p], block)
+			if target != nil && bytes.Compare(hash, target) > 0 {
+				continue
+			}
+			if len(res) == maxResults && bytes.Compare(hash, res[maxResults-1]) >= 0 {
+				continue
+			}
+
+			// Keep results sorted by hash
+			entry := make([]byte, 32+4+4)
+			copy(entry, hash)
+			binary.BigEndian.PutUint32(entry[32:], nonce)
+			binary.BigEndian.PutUint32(entry[36:], uint32(p))
+			at := sort.Search(len(res), func(k int) bool { return bytes.Compare(res[k], entry) > 0 })
+			if len(res) < maxResults {
+				res = append(res, nil)
+			}
+			copy(res[at+1:], res[at:])
+			res[at] = entry
+		}
+	}
+	return res
+}
+
+//
+// Clock
+//
+
+// frequency decodes MMCM counters written to the chip, chip runs at bitstream
+// default until PLL is written and is not clocked while powered down
+func (sim *Simulator) frequency(chip *simulatedChip) int {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	return sim.pllFrequency(chip)
+}
+
+func (sim *Simulator) pllFrequency(chip *simulatedChip) int {
+	if chip.pll[sim.options.Family.PLLPowerAddr] == 0xFFFF {
+		return 0
+	}
+	config, err := xilinx.DecodeMmcm(sim.options.Family, chip.pll)
+	if err != nil {
+		return sim.options.Frequency
+	}
+	return int(math.Round(config.Frequency(sim.options.Family.InputFrequency)))
+}
+
+// locked reports MMCM lock, it is lost while powered down and above
+// LockFrequency. Chip lock should be held.
+func (sim *Simulator) locked(chip *simulatedChip) bool {
+	if chip.pll[sim.options.Family.PLLPowerAddr] == 0xFFFF {
+		return false
+	}
+	return sim.options.LockFrequency == 0 || sim.pllFrequency(chip) <= sim.options.LockFrequency
+}
+
+// hashErrorRate grows quickly once chip is clocked above its limit
+func (sim *Simulator) hashErrorRate(frequency int) float64 {
+	if sim.options.MaxFrequency > 0 && frequency > sim.options.MaxFrequency {
+		return sim.options.HashErrorRate + float64(frequency-sim.options.MaxFrequency)/100
+	}
+	return sim.options.HashErrorRate
+}
+
+// temperature grows with frequency, 1 C per 20 MHz above default
+func (sim *Simulator) temperature(chip *simulatedChip) float32 {
+	return sim.options.Temperature + float32(sim.frequency(chip)-sim.options.Frequency)/20
+}
+
+//
+// Transport
+//
+
+func (sim *Simulator) respond(frame *protocol.Frame, chip *simulatedChip, data []byte) {
+	if frame.ChipID == protocol.BroadcastChipID || sim.chance(sim.options.DropRate) {
+		return
+	}
+	latency := sim.options.Latency
+	if sim.options.Chain {
+		latency += time.Duration(2*chip.position) * sim.options.HopLatency
+	}
+	packed := protocol.PackVersion(sim.options.Version, frame.ChipID, frame.Type, data)
+	if sim.chance(sim.options.CorruptRate) {
+		packed[1+sim.intn(len(packed)-2)] ^= 0x55
+	}
+	go func() {
+		time.Sleep(latency)
+		sim.writeLock.Lock()
+		defer sim.writeLock.Unlock()
+		sim.device.Write(packed)
+	}()
+}
+
+func (sim *Simulator) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	sim.randomLock.Lock()
+	defer sim.randomLock.Unlock()
+	return sim.random.Float64() < rate
+}
+
+func (sim *Simulator) intn(n int) int {
+	sim.randomLock.Lock()
+	defer sim.randomLock.Unlock()
+	return sim.random.Intn(n)
+}
+
+// simulatorConn closes simulated board together with the host end
+type simulatorConn struct {
+	io.ReadWriteCloser
+	sim *Simulator
+}
+
+func (conn *simulatorConn) Close() error {
+	conn.sim.Close()
+	return conn.ReadWriteCloser.Close()
+}
+
+// ParseOptions reads simulator knobs from URL query of a sim:// port:
+//
+//	sim://board?chips=6&chain=false&hop=1ms&version=1&cores=4&features=0x0&latency=5ms&job=1s&iterations=65536&temp=45&freq=100&maxfreq=300&maxlock=400&part=7k355tffg901&drop=0.01&corrupt=0.01&wrongjob=0.01&hasherror=0.01
+func ParseOptions(query url.Values) (Options, error) {
+	options := DefaultOptions
+	var err error
+	parseDuration := func(key string, v *time.Duration) {
+		if s := query.Get(key); s != "" && err == nil {
+			*v, err = time.ParseDuration(s)
+		}
+	}
+	parseRate := func(key string, v *float64) {
+		if s := query.Get(key); s != "" && err == nil {
+			*v, err = strconv.ParseFloat(s, 64)
+		}
+	}
+	if s := query.Get("chips"); s != "" {
+		options.Chips, err = strconv.Atoi(s)
+	}
+	if s := query.Get("chain"); s != "" && err == nil {
+		options.Chain, err = strconv.ParseBool(s)
+	}
+	if s := query.Get("version"); s != "" && err == nil {
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 8)
+		options.Version = uint8(v)
+	}
+	if s := query.Get("cores"); s != "" && err == nil {
+		options.Cores, err = strconv.Atoi(s)
+	}
+	if s := query.Get("features"); s != "" && err == nil {
+		var v uint64
+		v, err = strconv.ParseUint(s, 0, 32)
+		options.Features = uint32(v)
+	}
+	if s := query.Get("iterations"); s != "" && err == nil {
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 32)
+		options.MaxIterations = uint32(v)
+	}
+	if s := query.Get("temp"); s != "" && err == nil {
+		var v float64
+		v, err = strconv.ParseFloat(s, 32)
+		options.Temperature = float32(v)
+	}
+	if s := query.Get("freq"); s != "" && err == nil {
+		options.Frequency, err = strconv.Atoi(s)
+	}
+	if s := query.Get("maxfreq"); s != "" && err == nil {
+		options.MaxFrequency, err = strconv.Atoi(s)
+	}
+	if s := query.Get("maxlock"); s != "" && err == nil {
+		options.LockFrequency, err = strconv.Atoi(s)
+	}
+	if s := query.Get("part"); s != "" && err == nil {
+		options.Family, err = xilinx.FindFamilyByName(s)
+	}
+	parseDuration("latency", &options.Latency)
+	parseDuration("hop", &options.HopLatency)
+	parseDuration("job", &options.JobDuration)
+	parseRate("drop", &options.DropRate)
+	parseRate("corrupt", &options.CorruptRate)
+	parseRate("wrongjob", &options.WrongJobRate)
+	parseRate("hasherror", &options.HashErrorRate)
+	if err != nil {
+		return options, fmt.Errorf("invalid simulator options: %v", err)
+	}
+	return options, nil
+}
+
+// Open starts simulated board, closing returned stream stops the board
+func Open(options Options) io.ReadWriteCloser {
+	sim, host := New(options)
+	return &simulatorConn{ReadWriteCloser: host, sim: sim}
+}
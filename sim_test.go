@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/sim"
+	"github.com/ex3ndr/ai-agent/work"
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Error paths of the host driven through a simulated board
+//
+
+// openSim starts a quick simulated board and connects to it
+func openSim(t *testing.T, configure func(options *sim.Options)) *SerialChannel {
+	options := sim.DefaultOptions
+	options.Chips = 2
+	options.Latency = time.Millisecond
+	options.JobDuration = 10 * time.Millisecond
+	if configure != nil {
+		configure(&options)
+	}
+	channel := newSerialChannel(sim.Open(options), "sim")
+	t.Cleanup(channel.Close)
+	return channel
+}
+
+// simJob is a small job over an all-zero block
+func simJob(t *testing.T) *PreparedJob {
+	job, err := prepareJob(make([]byte, work.DataSize), 256, DefaultCapabilities.Prefixes, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestSimulatorJob(t *testing.T) {
+	channel := openSim(t, nil)
+	job := simJob(t)
+	jobId, err := channel.SubmitJob(1, job.Command, job.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outstanding := channel.OutstandingJobs(1); len(outstanding) != 1 || outstanding[0].ID != jobId {
+		t.Fatalf("submitted job is not outstanding: %+v", outstanding)
+	}
+	res, err := channel.WaitJob(context.Background(), 1, jobId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outstanding := channel.OutstandingJobs(1); len(outstanding) != 0 {
+		t.Fatalf("completed job is outstanding: %+v", outstanding)
+	}
+	shares, err := verifyJob(job, res, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 {
+		t.Fatalf("expected a single share, got %d", len(shares))
+	}
+	if stats := channel.JobStats(); stats.Submitted != 1 || stats.Completed != 1 {
+		t.Fatalf("unexpected job stats: %+v", stats)
+	}
+}
+
+func TestSimulatorTimeout(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.DropRate = 1
+	})
+	_, err := channel.RequestTimeout(1, 0xA2, []byte{protocol.ChipInfoCoinID}, 100*time.Millisecond)
+	if err != ErrRequestTimeout {
+		t.Fatalf("expected request timeout, got %v", err)
+	}
+}
+
+func TestSimulatorCorrupt(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.CorruptRate = 1
+	})
+	_, err := channel.RequestTimeout(1, 0xA2, []byte{protocol.ChipInfoCoinID}, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("corrupted response is accepted")
+	}
+
+	// Flipped byte either breaks checksum or framing
+	stats := channel.DecoderStats()
+	if stats.Frames != 0 || stats.BadChecksums+stats.BadFrames+stats.DroppedBytes == 0 {
+		t.Fatalf("corrupted frame is not counted: %+v", stats)
+	}
+}
+
+func TestSimulatorWrongJob(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.WrongJobRate = 1
+	})
+	job := simJob(t)
+	_, err := channel.PerformJob(context.Background(), 1, job.Command, job.Payload, 1)
+	if err == nil || err.Error() != "job timeout" {
+		t.Fatalf("expected job timeout, got %v", err)
+	}
+	if stats := channel.JobStats(); stats.Unknown == 0 || stats.Completed != 0 {
+		t.Fatalf("unknown job ID is not counted: %+v", stats)
+	}
+}
+
+func TestSimulatorHashError(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.HashErrorRate = 1
+	})
+	_, err := performJob(context.Background(), channel, make([]byte, work.DataSize), 256, nil, 1, 0, 1, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "hash mismatch") {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+}
+
+func TestSimulatorPoweredDown(t *testing.T) {
+	channel := openSim(t, nil)
+	family := channel.Family(1)
+	if err := channel.PllSet(1, family.PLLPowerAddr, 0xFFFF); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chip without clock keeps the job forever
+	job := simJob(t)
+	_, err := channel.PerformJob(context.Background(), 1, job.Command, job.Payload, 1)
+	if err == nil || err.Error() != "job timeout" {
+		t.Fatalf("expected job timeout, got %v", err)
+	}
+}
+
+func TestSimulatorChain(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.Chips = 3
+		options.Chain = true
+	})
+
+	// Chips don't answer before they get an address
+	if _, err := channel.RequestTimeout(1, 0xA2, []byte{protocol.ChipInfoCoinID}, 100*time.Millisecond); err == nil {
+		t.Fatal("chip answered before enumeration")
+	}
+
+	count, err := channel.EnumerateChain(MaxChainLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 chips, got %d", count)
+	}
+	for chip := 1; chip <= count; chip++ {
+		if _, err := channel.Handshake(chip); err != nil {
+			t.Fatalf("chip %d: %v", chip, err)
+		}
+	}
+
+	// Last chip is the furthest one
+	if channel.requestTimeout(3) <= channel.requestTimeout(1) {
+		t.Fatal("hops are not taken into account")
+	}
+
+	// Chain with the same profile on every chip is set by a single broadcast
+	store, err := LoadProfiles(filepath.Join(t.TempDir(), "profiles.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	board := &Board{Port: "sim", Channel: channel, Chained: true}
+	for chip := 1; chip <= count; chip++ {
+		board.Chips = append(board.Chips, &Chip{ID: chip})
+		if err := store.Put(&TuneProfile{Port: "sim", ChipID: chip, Bitstream: "test", Frequency: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !applyChainProfile(store, board, "test") {
+		t.Fatal("chain frequency is not broadcast")
+	}
+	for chip := 1; chip <= count; chip++ {
+		if frequency, err := channel.GetFrequency(chip); err != nil || frequency != 200 {
+			t.Fatalf("chip %d: expected 200 MHz, got %d %v", chip, frequency, err)
+		}
+	}
+
+	// Chips with own frequencies are set one by one
+	if err := store.Put(&TuneProfile{Port: "sim", ChipID: 2, Bitstream: "test", Frequency: 300}); err != nil {
+		t.Fatal(err)
+	}
+	if applyChainProfile(store, board, "test") {
+		t.Fatal("different frequencies are broadcast")
+	}
+}
+
+func TestSimulatorUnknownRegisterMap(t *testing.T) {
+	channel := openSim(t, nil)
+	channel.SetFamily(1, &xilinx.UltraScale)
+	if err := channel.SetFrequency(1, 100); err == nil {
+		t.Fatal("frequency is set without register map")
+	}
+	if err := channel.PllApply(1, xilinx.Series7.PLLFreq[100], &xilinx.UltraScale); err == nil {
+		t.Fatal("PLL is written without register map")
+	}
+	if err := channel.PllPowerDown(1, &xilinx.UltraScale); err == nil {
+		t.Fatal("PLL is powered down without register map")
+	}
+
+	// Nothing was written
+	if power, err := channel.PllGet(1, xilinx.UltraScale.PLLPowerAddr); err != nil || power == 0xFFFF {
+		t.Fatalf("unexpected power register: %04x %v", power, err)
+	}
+
+	// but registers are still read
+	values, err := channel.PllSnapshot(1, &xilinx.UltraScale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(xilinx.UltraScale.ReadRegisters()) {
+		t.Fatalf("unexpected snapshot: %v", values)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Sysmon gives access to XADC registers of a chip over DRP. Request is 0x7c
+// command of type 0x00 with operation, DRP address and value for writes, the
+// response holds a byte expected to echo the command and a 16 bit register
+// value. The echo is not confirmed by a capture of a real chip, so a mismatch
+// is only logged. Register
+// addresses are shared by XADC and UltraScale SYSMON, conversion of values
+// depends on chip family.
+//
+
+const SysmonInterval = 60 * time.Second
+
+// SysmonRead reads a raw XADC register
+func (channel *SerialChannel) SysmonRead(chipId int, addr uint8) (uint16, error) {
+	resp, err := channel.Request(chipId, 0x00, []byte{protocol.SysmonCommand, protocol.SysmonRead, addr, 0x00, 0x00})
+	if err != nil {
+		return 0, err
+	}
+	if err := channel.checkSysmonResponse(chipId, resp); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp.Data[1:]), nil
+}
+
+// SysmonWrite writes a raw XADC register
+func (channel *SerialChannel) SysmonWrite(chipId int, addr uint8, value uint16) error {
+	req := []byte{protocol.SysmonCommand, protocol.SysmonWrite, addr, 0x00, 0x00}
+	binary.BigEndian.PutUint16(req[3:], value)
+	resp, err := channel.Request(chipId, 0x00, req)
+	if err != nil {
+		return err
+	}
+	return channel.checkSysmonResponse(chipId, resp)
+}
+
+func (channel *SerialChannel) checkSysmonResponse(chipId int, resp *protocol.Frame) error {
+	if len(resp.Data) < 3 {
+		return fmt.Errorf("invalid sysmon response: %x", resp.Data)
+	}
+	if resp.Data[0] != protocol.SysmonCommand {
+		log.Printf("[%v] Sysmon response of chip %d doesn't echo the command: %x", channel.Tag, chipId, resp.Data)
+	}
+	return nil
+}
+
+// ReadSensor reads converted current value of a sensor
+func (channel *SerialChannel) ReadSensor(chipId int, sensor *xilinx.Sensor) (float32, error) {
+	raw, err := channel.SysmonRead(chipId, sensor.Addr)
+	if err != nil {
+		return 0, err
+	}
+	return channel.Family(chipId).SysmonValue(sensor, raw), nil
+}
+
+// SensorReading is a value of a sensor with min and max seen since power up
+type SensorReading struct {
+	Sensor *xilinx.Sensor
+	Value  float32
+	Min    float32
+	Max    float32
+}
+
+func (channel *SerialChannel) ReadSensorRange(chipId int, sensor *xilinx.Sensor) (*SensorReading, error) {
+	prop := channel.Family(chipId)
+	res := &SensorReading{Sensor: sensor}
+	for _, r := range []struct {
+		addr  uint8
+		value *float32
+	}{{sensor.Addr, &res.Value}, {sensor.Min, &res.Min}, {sensor.Max, &res.Max}} {
+		raw, err := channel.SysmonRead(chipId, r.addr)
+		if err != nil {
+			return nil, err
+		}
+		*r.value = prop.SysmonValue(sensor, raw)
+	}
+	return res, nil
+}
+
+// SetAlarm programs thresholds of a sensor, alarm is raised when value is out
+// of the range
+func (channel *SerialChannel) SetAlarm(chipId int, sensor *xilinx.Sensor, lower float32, upper float32) error {
+	if lower >= upper {
+		return fmt.Errorf("invalid %s alarm range %.2f..%.2f", sensor.Name, lower, upper)
+	}
+	prop := channel.Family(chipId)
+	if err := channel.SysmonWrite(chipId, sensor.Lower, prop.SysmonRaw(sensor, lower)); err != nil {
+		return err
+	}
+	return channel.SysmonWrite(chipId, sensor.Upper, prop.SysmonRaw(sensor, upper))
+}
+
+// SetOverTemperature programs automatic shutdown of a chip at limit, chip is
+// started again once it cools down to reset
+func (channel *SerialChannel) SetOverTemperature(chipId int, limit float32, reset float32) error {
+	if reset >= limit {
+		return fmt.Errorf("invalid overtemperature range %.2f..%.2f", reset, limit)
+	}
+	prop := channel.Family(chipId)
+	if err := channel.SysmonWrite(chipId, xilinx.SysmonOTReset, prop.SysmonRaw(&xilinx.SensorTemp, reset)); err != nil {
+		return err
+	}
+	return channel.SysmonWrite(chipId, xilinx.SysmonOTLimit, prop.SysmonRaw(&xilinx.SensorTemp, limit))
+}
+
+// SysmonAlarms reads flag register
+func (channel *SerialChannel) SysmonAlarms(chipId int) (xilinx.SysmonFlag, error) {
+	raw, err := channel.SysmonRead(chipId, xilinx.SysmonFlags)
+	if err != nil {
+		return 0, err
+	}
+	return xilinx.SysmonFlag(raw), nil
+}
+
+// SysmonStatus is a snapshot of all sensors and alarms of a chip
+type SysmonStatus struct {
+	Readings []*SensorReading
+	Flags    xilinx.SysmonFlag
+}
+
+func (channel *SerialChannel) ReadSysmon(chipId int) (*SysmonStatus, error) {
+	res := &SysmonStatus{Readings: make([]*SensorReading, 0, len(xilinx.Sensors))}
+	for _, sensor := range xilinx.Sensors {
+		reading, err := channel.ReadSensorRange(chipId, sensor)
+		if err != nil {
+			return nil, err
+		}
+		res.Readings = append(res.Readings, reading)
+	}
+	flags, err := channel.SysmonAlarms(chipId)
+	if err != nil {
+		return nil, err
+	}
+	res.Flags = flags
+	return res, nil
+}
+
+func (status *SysmonStatus) String() string {
+	parts := make([]string, 0, len(status.Readings)+1)
+	for _, r := range status.Readings {
+		parts = append(parts, fmt.Sprintf("%s=%.3f%s (%.3f..%.3f)", r.Sensor.Name, r.Value, r.Sensor.Unit(), r.Min, r.Max))
+	}
+	parts = append(parts, "alarms="+status.Flags.String())
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,3 @@
+set -e
+go build -o build/ai-local
+./build/ai-local --port "sim://board?chips=6&job=500ms" --chip 1 --iterations 10000 --config ./test_0001.hex
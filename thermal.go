@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// ThermalGovernor keeps a chip within temperature limits: frequency is stepped
+// down above Throttle, job submission is paused above Pause and the chip clock
+// is stopped above Critical. A state is left only once the chip cooled down
+// by Hysteresis below its threshold, frequency is then stepped back up.
+//
+
+const (
+	DefaultThrottleTemperature = 90
+	DefaultPauseTemperature    = 95
+	DefaultCriticalTemperature = 100
+	DefaultThermalHysteresis   = 5
+	ThermalInterval            = 5 * time.Second
+)
+
+type ThermalState int
+
+const (
+	ThermalNormal ThermalState = iota
+	ThermalThrottled
+	ThermalPaused
+	ThermalStopped
+)
+
+func (state ThermalState) String() string {
+	switch state {
+	case ThermalNormal:
+		return "normal"
+	case ThermalThrottled:
+		return "throttled"
+	case ThermalPaused:
+		return "paused"
+	case ThermalStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+type ThermalPolicy struct {
+	Throttle   float32
+	Pause      float32
+	Critical   float32
+	Hysteresis float32
+
+	// Frequency is never stepped below MinFrequency
+	MinFrequency int
+}
+
+var DefaultThermalPolicy = ThermalPolicy{
+	Throttle:     DefaultThrottleTemperature,
+	Pause:        DefaultPauseTemperature,
+	Critical:     DefaultCriticalTemperature,
+	Hysteresis:   DefaultThermalHysteresis,
+	MinFrequency: DefaultTuneMinFrequency,
+}
+
+func (policy *ThermalPolicy) threshold(state ThermalState) float32 {
+	switch state {
+	case ThermalThrottled:
+		return policy.Throttle
+	case ThermalPaused:
+		return policy.Pause
+	case ThermalStopped:
+		return policy.Critical
+	}
+	return 0
+}
+
+// next is the highest state whose threshold is reached, thresholds of the
+// current state and below are lowered by hysteresis
+func (policy *ThermalPolicy) next(state ThermalState, temperature float32) ThermalState {
+	res := ThermalNormal
+	for s := ThermalThrottled; s <= ThermalStopped; s++ {
+		limit := policy.threshold(s)
+		if s <= state {
+			limit -= policy.Hysteresis
+		}
+		if temperature >= limit {
+			res = s
+		}
+	}
+	return res
+}
+
+// ThermalEvent is a state or frequency change of a chip, or a failed attempt
+// to change state when Err is set
+type ThermalEvent struct {
+	Board       int
+	ChipID      int
+	State       ThermalState
+	Temperature float32
+	Frequency   int
+	Time        time.Time
+	Err         error
+}
+
+type ThermalGovernor struct {
+	Port   *SerialChannel
+	Board  int
+	ChipID int
+	Policy ThermalPolicy
+
+	// OnTemperature receives every reading, OnEvent every state or frequency
+	// change and every failed state change
+	OnTemperature func(temperature float32)
+	OnEvent       func(event ThermalEvent)
+
+	lock    sync.Mutex
+	state   ThermalState
+	resumed chan struct{}
+
+	// Frequency is zero when it could not be read, throttling is disabled
+	// then. Target is the frequency chip returns to after throttling.
+	frequency int
+	target    int
+
+	// Power is the PLL power register of a stopped chip before it was stopped,
+	// stopped is set once MMCM could have been powered down
+	power   uint16
+	stopped bool
+}
+
+func NewThermalGovernor(port *SerialChannel, board int, chipId int, policy ThermalPolicy) *ThermalGovernor {
+	return &ThermalGovernor{
+		Port:   port,
+		Board:  board,
+		ChipID: chipId,
+		Policy: policy,
+	}
+}
+
+func (governor *ThermalGovernor) State() ThermalState {
+	governor.lock.Lock()
+	defer governor.lock.Unlock()
+	return governor.state
+}
+
+// Wait blocks while job submission is paused, returns true if it waited
+func (governor *ThermalGovernor) Wait() bool {
+	governor.lock.Lock()
+	if governor.state < ThermalPaused {
+		governor.lock.Unlock()
+		return false
+	}
+	resumed := governor.resumed
+	governor.lock.Unlock()
+	<-resumed
+	return true
+}
+
+// Run watches the chip forever
+func (governor *ThermalGovernor) Run() {
+	frequency, err := governor.Port.GetFrequency(governor.ChipID)
+	if err != nil {
+		log.Printf("[%2d] Chip %d: frequency unknown, throttling disabled: %v\n", governor.Board, governor.ChipID, err)
+	}
+	governor.frequency = frequency
+	governor.target = frequency
+
+	for {
+		temperature, err := governor.Port.GetTemperature(governor.ChipID)
+		if err != nil {
+			log.Printf("[%2d] %v\n", governor.Board, err)
+			delayRetry()
+			continue
+		}
+		if governor.OnTemperature != nil {
+			governor.OnTemperature(temperature)
+		}
+		governor.update(temperature)
+		time.Sleep(ThermalInterval)
+	}
+}
+
+func (governor *ThermalGovernor) update(temperature float32) {
+	state := governor.State()
+	next := governor.Policy.next(state, temperature)
+	if next != state {
+
+		// Failed transition is retried on next reading
+		reached, err := governor.transition(state, next)
+		if err != nil {
+			log.Printf("[%2d] Chip %d: unable to switch to %v, now %v: %v\n", governor.Board, governor.ChipID, next, reached, err)
+			governor.emit(reached, temperature, err)
+			return
+		}
+		governor.event(next, temperature)
+	}
+
+	// Stopped chip has no clock to adjust
+	switch {
+	case next == ThermalStopped:
+	case temperature >= governor.Policy.Throttle:
+		governor.step(false, temperature)
+	case next == ThermalNormal && governor.frequency < governor.target:
+		governor.step(true, temperature)
+	}
+}
+
+// transition stops or resumes chip clock and job submission and returns the
+// state reached. Chip that could not be stopped is paused, so jobs are not
+// sent to it whether it answers or not. State is not changed if chip could
+// not be restarted.
+func (governor *ThermalGovernor) transition(from ThermalState, to ThermalState) (ThermalState, error) {
+	var err error
+	if to == ThermalStopped && from != ThermalStopped {
+		if err = governor.stop(); err != nil {
+			err = fmt.Errorf("unable to stop chip: %v", err)
+			to = ThermalPaused
+		}
+	} else if to != ThermalStopped && governor.stopped {
+		if err := governor.Port.PllRestart(governor.ChipID, governor.power, governor.Port.Family(governor.ChipID)); err != nil {
+			return from, fmt.Errorf("unable to restart chip: %v", err)
+		}
+		governor.stopped = false
+	}
+
+	governor.lock.Lock()
+	defer governor.lock.Unlock()
+	if to >= ThermalPaused && governor.state < ThermalPaused {
+		governor.resumed = make(chan struct{})
+	}
+	if to < ThermalPaused && governor.state >= ThermalPaused {
+		close(governor.resumed)
+	}
+	governor.state = to
+	return to, err
+}
+
+// stop aborts current job and powers MMCM down, the chip keeps answering
+// sysmon queries without a clock
+func (governor *ThermalGovernor) stop() error {
+	if err := governor.Port.AbortJob(governor.ChipID); err != nil {
+		log.Printf("[%2d] Chip %d: unable to abort job: %v\n", governor.Board, governor.ChipID, err)
+	}
+	prop := governor.Port.Family(governor.ChipID)
+	if _, err := prop.Registers(); err != nil {
+		return err
+	}
+	power, err := governor.Port.PllGet(governor.ChipID, prop.PLLPowerAddr)
+	if err != nil {
+		return err
+	}
+
+	// Previous attempt could have powered MMCM down without confirming it
+	if power != 0xFFFF {
+		governor.power = power
+	}
+	governor.stopped = true
+	return governor.Port.PllPowerDown(governor.ChipID, prop)
+}
+
+// step moves frequency to the neighbouring one of PLL table, target is
+// restored even if it is not in the table
+func (governor *ThermalGovernor) step(up bool, temperature float32) {
+	if governor.frequency == 0 {
+		return
+	}
+	frequency := 0
+	if up {
+		frequency = governor.target
+	}
+	for _, f := range governor.Port.Family(governor.ChipID).Frequencies() {
+		if up && f > governor.frequency && f < governor.target {
+			frequency = f
+			break
+		}
+		if !up && f < governor.frequency && f >= governor.Policy.MinFrequency {
+			frequency = f
+		}
+	}
+	if frequency == 0 || frequency == governor.frequency {
+		return
+	}
+	if err := governor.Port.SetFrequency(governor.ChipID, frequency); err != nil {
+		log.Printf("[%2d] Chip %d: unable to set frequency %d MHz: %v\n", governor.Board, governor.ChipID, frequency, err)
+		return
+	}
+	governor.frequency = frequency
+	governor.event(governor.State(), temperature)
+}
+
+func (governor *ThermalGovernor) event(state ThermalState, temperature float32) {
+	log.Printf("[%2d] Chip %d: %.2f C, %v at %d MHz\n", governor.Board, governor.ChipID, temperature, state, governor.frequency)
+	governor.emit(state, temperature, nil)
+}
+
+func (governor *ThermalGovernor) emit(state ThermalState, temperature float32, err error) {
+	if governor.OnEvent != nil {
+		governor.OnEvent(ThermalEvent{
+			Board:       governor.Board,
+			ChipID:      governor.ChipID,
+			State:       state,
+			Temperature: temperature,
+			Frequency:   governor.frequency,
+			Time:        time.Now(),
+			Err:         err,
+		})
+	}
+}
+
+// WorstThermalState is the highest state of all governors
+func WorstThermalState(governors []*ThermalGovernor) ThermalState {
+	res := ThermalNormal
+	for _, governor := range governors {
+		if state := governor.State(); state > res {
+			res = state
+		}
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/sim"
+)
+
+func TestThermalGovernorStop(t *testing.T) {
+	channel := openSim(t, nil)
+	if _, err := channel.Handshake(1); err != nil {
+		t.Fatal(err)
+	}
+	events := make([]ThermalEvent, 0)
+	governor := NewThermalGovernor(channel, 0, 1, DefaultThermalPolicy)
+	governor.OnEvent = func(event ThermalEvent) {
+		events = append(events, event)
+	}
+	addr := channel.Family(1).PLLPowerAddr
+	power, err := channel.PllGet(1, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clock is stopped above critical temperature
+	governor.update(DefaultCriticalTemperature + 1)
+	if governor.State() != ThermalStopped {
+		t.Fatalf("expected stopped chip, got %v", governor.State())
+	}
+	if value, err := channel.PllGet(1, addr); err != nil || value != 0xFFFF {
+		t.Fatalf("MMCM is not powered down: %04x %v", value, err)
+	}
+
+	// and restarted with the original power once chip cooled down
+	governor.update(DefaultThrottleTemperature - DefaultThermalHysteresis - 1)
+	if governor.State() != ThermalNormal {
+		t.Fatalf("expected normal chip, got %v", governor.State())
+	}
+	if value, err := channel.PllGet(1, addr); err != nil || value != power {
+		t.Fatalf("MMCM power is not restored: %04x %v", value, err)
+	}
+	if locked, err := channel.PllLocked(1); err != nil || !locked {
+		t.Fatalf("MMCM is not locked: %v", err)
+	}
+	if len(events) != 2 || events[0].Err != nil || events[1].Err != nil {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestThermalGovernorStopFailed(t *testing.T) {
+	channel := openSim(t, func(options *sim.Options) {
+		options.DropRate = 1
+	})
+	events := make([]ThermalEvent, 0)
+	governor := NewThermalGovernor(channel, 0, 1, DefaultThermalPolicy)
+	governor.OnEvent = func(event ThermalEvent) {
+		events = append(events, event)
+	}
+
+	// Chip that was not stopped is paused, so jobs are not sent to it
+	governor.update(DefaultCriticalTemperature + 1)
+	if governor.State() != ThermalPaused {
+		t.Fatalf("expected paused chip, got %v", governor.State())
+	}
+	if len(events) != 1 || events[0].Err == nil || events[0].State != ThermalPaused {
+		t.Fatalf("failure is not reported: %+v", events)
+	}
+	waited := make(chan bool)
+	go func() {
+		waited <- governor.Wait()
+	}()
+	select {
+	case <-waited:
+		t.Fatal("job submission is not paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and stop is retried on every reading
+	governor.update(DefaultCriticalTemperature + 1)
+	if governor.State() != ThermalPaused || len(events) != 2 || events[1].Err == nil {
+		t.Fatalf("stop is not retried: %v %+v", governor.State(), events)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Topology of a rig: boards are connected to own ports and each board has a
+// number of chips. Rig is discovered on startup by probing every candidate
+// port for every chip ID.
+//
+
+const (
+	// DefaultRigPorts are UARTs of the controller boards are wired to, their
+	// order defines board indexes used in stats
+	DefaultRigPorts = "/dev/ttyO1,/dev/ttyO2,/dev/ttyO5"
+	DefaultMaxChip  = 8
+	ProbeTimeout    = 300 * time.Millisecond
+)
+
+type Topology struct {
+	Boards []*Board
+}
+
+type Board struct {
+	Index   int
+	Port    string
+	Channel *SerialChannel
+	Chips   []*Chip
+
+	// Chained board takes broadcast frames
+	Chained bool
+}
+
+type Chip struct {
+	ID           int
+	Capabilities *ChipCapabilities
+	Family       *xilinx.Family
+}
+
+// TemperatureID is a stable ID of a chip used in stats
+func (board *Board) TemperatureID(chip *Chip) string {
+	return fmt.Sprintf("chip_%d_%d", board.Index, chip.ID-1)
+}
+
+func (topology *Topology) ChipCount() int {
+	res := 0
+	for _, board := range topology.Boards {
+		res += len(board.Chips)
+	}
+	return res
+}
+
+func (topology *Topology) String() string {
+	parts := make([]string, 0)
+	for _, board := range topology.Boards {
+		ids := make([]string, 0)
+		for _, chip := range board.Chips {
+			ids = append(ids, fmt.Sprintf("%d", chip.ID))
+		}
+		parts = append(parts, fmt.Sprintf("[%d] %s: chips %s", board.Index, board.Port, strings.Join(ids, ",")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ResolvePorts expands comma separated list of port specs. Board index is a
+// position in the list, so it doesn't change when a board is missing. Globs are
+// only expanded when given explicitly, matches are sorted, but indexes of
+// boards after a glob shift with the number of ports it matched.
+func ResolvePorts(spec string) []string {
+	res := make([]string, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "://") || !strings.ContainsAny(part, "*?[") {
+			res = append(res, part)
+			continue
+		}
+		matches, err := filepath.Glob(part)
+		if err != nil {
+			log.Printf("Invalid port pattern %s: %v", part, err)
+			continue
+		}
+		sort.Strings(matches)
+		res = append(res, matches...)
+	}
+	return res
+}
+
+// DiscoverTopology probes all ports in parallel. Ports without responding
+// chips are closed and skipped. Chained boards are enumerated first. Jobs left
+// on chips by a previous run are discarded, running ones are aborted on reset.
+// All chips are expected to be of the same family.
+func DiscoverTopology(ports []string, maxChip int, chain bool, resetJobs bool, family *xilinx.Family) *Topology {
+	boards := make([]*Board, len(ports))
+	var wg sync.WaitGroup
+	for i := range ports {
+		index := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			board, err := discoverBoard(index, ports[index], maxChip, chain, resetJobs, family)
+			if err != nil {
+				log.Printf("[%2d] %s: %v\n", index, ports[index], err)
+				return
+			}
+			boards[index] = board
+		}()
+	}
+	wg.Wait()
+
+	res := &Topology{Boards: make([]*Board, 0)}
+	for _, board := range boards {
+		if board != nil {
+			res.Boards = append(res.Boards, board)
+		}
+	}
+	return res
+}
+
+func discoverBoard(index int, port string, maxChip int, chain bool, resetJobs bool, family *xilinx.Family) (*Board, error) {
+	channel, err := SerialOpen(port, 115200)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chips of a chain get addresses in chain order
+	if chain {
+		length, err := channel.EnumerateChain(maxChip)
+		if err != nil {
+			channel.Close()
+			return nil, err
+		}
+		log.Printf("[%2d] Chain of %d chips\n", index, length)
+		maxChip = length
+	}
+	board := &Board{Index: index, Port: port, Channel: channel, Chips: make([]*Chip, 0), Chained: chain}
+	for chipId := 1; chipId <= maxChip; chipId++ {
+
+		// Probe with a status check that doesn't change chip state
+		_, err := channel.RequestTimeout(chipId, 0x00, []byte{0x9a}, ProbeTimeout+channel.hopDelay(chipId))
+		if err != nil {
+			continue
+		}
+
+		channel.SetFamily(chipId, family)
+		caps, err := channel.Handshake(chipId)
+		if err != nil {
+			log.Printf("[%2d] Handshake with chip %d failed, using defaults: %v\n", index, chipId, err)
+			caps = channel.Capabilities(chipId)
+		}
+		if err := channel.Reconcile(chipId, resetJobs); err != nil {
+			log.Printf("[%2d] Unable to recover job state of chip %d: %v\n", index, chipId, err)
+		}
+		log.Printf("[%2d] Found %v chip %d: %v\n", index, family, chipId, caps)
+		board.Chips = append(board.Chips, &Chip{ID: chipId, Capabilities: caps, Family: family})
+	}
+	if len(board.Chips) == 0 {
+		channel.Close()
+		return nil, fmt.Errorf("no chips found")
+	}
+	return board, nil
+}
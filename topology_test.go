@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolvePorts(t *testing.T) {
+
+	// Default boards keep indexes of fixed ports even if devices are missing
+	ports := ResolvePorts(DefaultRigPorts)
+	if !reflect.DeepEqual(ports, []string{"/dev/ttyO1", "/dev/ttyO2", "/dev/ttyO5"}) {
+		t.Fatalf("unexpected default ports: %v", ports)
+	}
+
+	// Patterns are expanded in sorted order, URLs are kept as is
+	dir := t.TempDir()
+	for _, name := range []string{"ttyS2", "ttyS1", "ttyUSB0"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ports = ResolvePorts("sim://board?chips=2, " + filepath.Join(dir, "ttyS*") + ",,/dev/ttyO5")
+	expected := []string{"sim://board?chips=2", filepath.Join(dir, "ttyS1"), filepath.Join(dir, "ttyS2"), "/dev/ttyO5"}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Fatalf("expected %v, got %v", expected, ports)
+	}
+}
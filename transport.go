@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/sim"
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// TransportOpener opens a byte stream to a board described by port URL
+type TransportOpener func(spec *url.URL, speed uint) (io.ReadWriteCloser, error)
+
+var transports = map[string]TransportOpener{
+	"serial": openSerialTransport,
+	"tcp":    openTCPTransport,
+	"unix":   openUnixTransport,
+	"sim":    openSimulatorTransport,
+}
+
+const TransportDialTimeout = 10 * time.Second
+
+// OpenTransport opens port by spec. Spec is either a plain device path or URL:
+//
+//	serial:///dev/ttyO1?baud=115200
+//	tcp://10.0.0.5:4001
+//	unix:///var/run/board.sock
+//	sim://board?chips=6
+//
+// speed is used as baud rate when spec does not have one.
+func OpenTransport(spec string, speed uint) (io.ReadWriteCloser, error) {
+	if !strings.Contains(spec, "://") {
+		return openSerial(spec, speed)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	opener, found := transports[u.Scheme]
+	if !found {
+		return nil, fmt.Errorf("unsupported transport: %s", u.Scheme)
+	}
+	return opener(u, speed)
+}
+
+//
+// Serial
+//
+
+func openSerialTransport(spec *url.URL, speed uint) (io.ReadWriteCloser, error) {
+	if b := spec.Query().Get("baud"); b != "" {
+		baud, err := strconv.ParseUint(b, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid baud rate: %s", b)
+		}
+		speed = uint(baud)
+	}
+	return openSerial(spec.Host+spec.Path, speed)
+}
+
+func openSerial(path string, speed uint) (io.ReadWriteCloser, error) {
+	res, err := serial.Open(serial.OpenOptions{
+		PortName:              path,
+		BaudRate:              speed,
+		DataBits:              8,
+		StopBits:              1,
+		InterCharacterTimeout: 100,
+		MinimumReadSize:       0,
+		RTSCTSFlowControl:     false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serialPort{res}, nil
+}
+
+// serialPort reports inter character timeout as an empty read instead of io.EOF
+type serialPort struct {
+	io.ReadWriteCloser
+}
+
+func (port *serialPort) Read(p []byte) (int, error) {
+	n, err := port.ReadWriteCloser.Read(p)
+	if err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+//
+// Sockets
+//
+
+func openSimulatorTransport(spec *url.URL, speed uint) (io.ReadWriteCloser, error) {
+	options, err := sim.ParseOptions(spec.Query())
+	if err != nil {
+		return nil, err
+	}
+	return sim.Open(options), nil
+}
+
+func openTCPTransport(spec *url.URL, speed uint) (io.ReadWriteCloser, error) {
+	conn, err := net.DialTimeout("tcp", spec.Host, TransportDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.(*net.TCPConn).SetNoDelay(true)
+	return conn, nil
+}
+
+func openUnixTransport(spec *url.URL, speed uint) (io.ReadWriteCloser, error) {
+	return net.DialTimeout("unix", spec.Host+spec.Path, TransportDialTimeout)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/xilinx"
+)
+
+//
+// Autotuner steps a chip through the PLL frequency table, runs a few jobs at
+// every step and picks the highest frequency the chip is stable at, minus a
+// safety margin. Results are stored per board, chip and bitstream so tuning
+// only happens once.
+//
+
+const (
+	DefaultTuneJobs         = 5
+	DefaultTuneIterations   = 1 << 24
+	DefaultTuneMargin       = 1
+	DefaultTuneMaxErrorRate = 0.0
+	DefaultTuneMaxTemp      = 85
+	DefaultTuneMinFrequency = 100
+	DefaultTuneHashrateDrop = 0.1
+)
+
+type Autotuner struct {
+	Port   *SerialChannel
+	Board  int
+	ChipID int
+
+	// Frequencies are tried in ascending order starting from MinFrequency
+	MinFrequency int
+	Jobs         int
+	Iterations   uint32
+	Timeout      int
+
+	// Step is stable when hash mismatch rate and temperature are within limits
+	// and hashrate didn't drop by more than HashrateDrop from the previous
+	// step. Margin is a number of stable steps chosen frequency is below the
+	// highest stable one.
+	MaxErrorRate   float64
+	MaxTemperature float32
+	HashrateDrop   float64
+	Margin         int
+}
+
+type TuneStep struct {
+	Frequency   int
+	Jobs        int
+	Errors      int
+	Hashrate    float64
+	Temperature float32
+}
+
+func (step *TuneStep) ErrorRate() float64 {
+	if step.Jobs == 0 {
+		return 1
+	}
+	return float64(step.Errors) / float64(step.Jobs)
+}
+
+func NewAutotuner(port *SerialChannel, board int, chipId int) *Autotuner {
+	return &Autotuner{
+		Port:           port,
+		Board:          board,
+		ChipID:         chipId,
+		MinFrequency:   DefaultTuneMinFrequency,
+		Jobs:           DefaultTuneJobs,
+		Iterations:     DefaultTuneIterations,
+		Timeout:        60,
+		MaxErrorRate:   DefaultTuneMaxErrorRate,
+		MaxTemperature: DefaultTuneMaxTemp,
+		HashrateDrop:   DefaultTuneHashrateDrop,
+		Margin:         DefaultTuneMargin,
+	}
+}
+
+// Run tunes the chip and leaves it at the chosen frequency. PLL is restored to
+// its original state when no frequency is stable.
+func (tuner *Autotuner) Run() (int, []TuneStep, error) {
+	prop := tuner.Port.Family(tuner.ChipID)
+	original, err := tuner.Port.PllSnapshot(tuner.ChipID, prop)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	steps := make([]TuneStep, 0)
+	stable := make([]TuneStep, 0)
+	for _, frequency := range prop.Frequencies() {
+		if frequency < tuner.MinFrequency {
+			continue
+		}
+		step, err := tuner.measure(frequency)
+
+		// Chip is back at the previous frequency when PLL was rolled back
+		var pllErr *PllError
+		if errors.As(err, &pllErr) && pllErr.RolledBack {
+			log.Printf("[%2d] Chip %d: %d MHz rejected: %v\n", tuner.Board, tuner.ChipID, frequency, err)
+			break
+		}
+		if err != nil {
+			tuner.restore(original)
+			return 0, steps, err
+		}
+		steps = append(steps, *step)
+		log.Printf("[%2d] Chip %d: %d MHz, %.0f H/s, %d/%d errors, %.2f C\n", tuner.Board, tuner.ChipID,
+			step.Frequency, step.Hashrate, step.Errors, step.Jobs, step.Temperature)
+
+		// Higher frequencies are not expected to be better once chip fails
+		if !tuner.accepts(step, stable) {
+			break
+		}
+		stable = append(stable, *step)
+	}
+
+	if len(stable) == 0 {
+		tuner.restore(original)
+		return 0, steps, errors.New("no stable frequency found")
+	}
+	frequency := tuner.choose(stable)
+	if err := tuner.Port.SetFrequency(tuner.ChipID, frequency); err != nil {
+		return 0, steps, err
+	}
+	return frequency, steps, nil
+}
+
+// accepts checks that step is stable: hash mismatch rate and temperature are
+// within limits and hashrate didn't drop from the last stable step
+func (tuner *Autotuner) accepts(step *TuneStep, stable []TuneStep) bool {
+	if step.ErrorRate() > tuner.MaxErrorRate || step.Temperature > tuner.MaxTemperature {
+		return false
+	}
+	return len(stable) == 0 || step.Hashrate >= stable[len(stable)-1].Hashrate*(1-tuner.HashrateDrop)
+}
+
+// choose picks frequency Margin stable steps below the highest stable one
+func (tuner *Autotuner) choose(stable []TuneStep) int {
+	chosen := len(stable) - 1 - tuner.Margin
+	if chosen < 0 {
+		chosen = 0
+	}
+	return stable[chosen].Frequency
+}
+
+func (tuner *Autotuner) measure(frequency int) (*TuneStep, error) {
+	if err := tuner.Port.SetFrequency(tuner.ChipID, frequency); err != nil {
+		return nil, err
+	}
+	step := &TuneStep{Frequency: frequency}
+	prefixes := tuner.Port.Capabilities(tuner.ChipID).Prefixes
+	start := time.Now()
+	for i := 0; i < tuner.Jobs; i++ {
+
+		// Random block, results are only verified and never reported
+		data := make([]byte, 123)
+		rand.Read(data)
+		job, err := prepareJob(data, tuner.Iterations, prefixes, nil, tuner.Board, false)
+		if err != nil {
+			return nil, err
+		}
+		response, err := tuner.Port.PerformJob(context.Background(), tuner.ChipID, job.Command, job.Payload, tuner.Timeout)
+		step.Jobs++
+		if err != nil {
+			step.Errors++
+			continue
+		}
+		if _, err := verifyJob(job, response, tuner.Board, false); err != nil {
+			step.Errors++
+		}
+	}
+	elapsed := time.Since(start)
+	hashes := hashesPerJob(tuner.Port, tuner.ChipID, int(tuner.Iterations)) * int64(step.Jobs-step.Errors)
+	step.Hashrate = float64(hashes) / elapsed.Seconds()
+
+	temperature, err := tuner.Port.GetTemperature(tuner.ChipID)
+	if err != nil {
+		return nil, err
+	}
+	step.Temperature = temperature
+	return step, nil
+}
+
+func (tuner *Autotuner) restore(original []xilinx.PllConstValue) {
+	if err := tuner.Port.PllApply(tuner.ChipID, original, tuner.Port.Family(tuner.ChipID)); err != nil {
+		log.Printf("[%2d] Chip %d: unable to restore PLL: %v\n", tuner.Board, tuner.ChipID, err)
+	}
+}
+
+// PllSnapshot reads all MMCM registers of the family, the result could be
+// passed to PllApply to restore them
+func (channel *SerialChannel) PllSnapshot(chipId int, prop *xilinx.Family) ([]xilinx.PllConstValue, error) {
+	addrs := make([]uint8, 0)
+	seen := make(map[uint8]bool)
+	for _, c := range prop.ReadRegisters() {
+		if !seen[c.Addr] {
+			addrs = append(addrs, c.Addr)
+			seen[c.Addr] = true
+		}
+	}
+	res := make([]xilinx.PllConstValue, 0, len(addrs))
+	for _, addr := range addrs {
+		value, err := channel.PllGet(chipId, addr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, xilinx.PllConstValue{Const: xilinx.PllConst{Addr: addr, Mask: 0}, Value: value})
+	}
+	return res, nil
+}
+
+//
+// Profiles
+//
+
+type TuneProfile struct {
+	Port      string    `json:"port"`
+	ChipID    int       `json:"chip"`
+	Bitstream string    `json:"bitstream"`
+	Frequency int       `json:"frequency"`
+	Hashrate  float64   `json:"hashrate"`
+	Tuned     time.Time `json:"tuned"`
+}
+
+// ProfileStore keeps tuning profiles in a JSON file
+type ProfileStore struct {
+	path     string
+	lock     sync.Mutex
+	profiles map[string]*TuneProfile
+}
+
+func profileKey(port string, chipId int, bitstream string) string {
+	return fmt.Sprintf("%s/%s/%d", bitstream, port, chipId)
+}
+
+// LoadProfiles reads profiles from file, missing file is an empty store
+func LoadProfiles(path string) (*ProfileStore, error) {
+	store := &ProfileStore{path: path, profiles: make(map[string]*TuneProfile)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]*TuneProfile, 0)
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %v", path, err)
+	}
+	for _, profile := range profiles {
+		store.profiles[profileKey(profile.Port, profile.ChipID, profile.Bitstream)] = profile
+	}
+	return store, nil
+}
+
+func (store *ProfileStore) Get(port string, chipId int, bitstream string) *TuneProfile {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.profiles[profileKey(port, chipId, bitstream)]
+}
+
+// Put stores profile and writes the whole file, file is replaced atomically
+// so a crash never leaves it truncated
+func (store *ProfileStore) Put(profile *TuneProfile) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.profiles[profileKey(profile.Port, profile.ChipID, profile.Bitstream)] = profile
+
+	keys := make([]string, 0, len(store.profiles))
+	for key := range store.profiles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	profiles := make([]*TuneProfile, 0, len(keys))
+	for _, key := range keys {
+		profiles = append(profiles, store.profiles[key])
+	}
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
+
+// bitstreamID identifies bitstream by name and content, so a rebuilt bitstream
+// with the same name is tuned again
+func bitstreamID(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	sum := sha256.Sum256(data)
+	return filepath.Base(path) + ":" + hex.EncodeToString(sum[:4])
+}
+
+// applyChainProfile sets frequency of a whole chain with a single broadcast when
+// every chip of it has a profile with the same frequency. Returns false if
+// chips have to be set one by one.
+func applyChainProfile(store *ProfileStore, board *Board, bitstream string) bool {
+	if !board.Chained || len(board.Chips) == 0 {
+		return false
+	}
+	frequency := 0
+	for _, chip := range board.Chips {
+		profile := store.Get(board.Port, chip.ID, bitstream)
+		if profile == nil || (frequency != 0 && profile.Frequency != frequency) {
+			return false
+		}
+		frequency = profile.Frequency
+	}
+	log.Printf("[%2d] Chain: applying tuned frequency %d MHz to %d chips\n", board.Index, frequency, len(board.Chips))
+	if err := board.Channel.BroadcastFrequency(board.Chips[0].ID, frequency); err != nil {
+		log.Printf("[%2d] Chain: unable to set frequency, setting chips one by one: %v\n", board.Index, err)
+		return false
+	}
+	return true
+}
+
+// applyProfile sets frequency of a chip from stored profile, or tunes the chip
+// when there is no profile and tuning is enabled
+func applyProfile(store *ProfileStore, board *Board, chip *Chip, bitstream string, tune bool) {
+	profile := store.Get(board.Port, chip.ID, bitstream)
+	if profile != nil {
+		log.Printf("[%2d] Chip %d: applying tuned frequency %d MHz\n", board.Index, chip.ID, profile.Frequency)
+		if err := board.Channel.SetFrequency(chip.ID, profile.Frequency); err != nil {
+			log.Printf("[%2d] Chip %d: unable to set frequency: %v\n", board.Index, chip.ID, err)
+		}
+		return
+	}
+	if !tune {
+		return
+	}
+
+	log.Printf("[%2d] Chip %d: tuning frequency\n", board.Index, chip.ID)
+	tuner := NewAutotuner(board.Channel, board.Index, chip.ID)
+	frequency, steps, err := tuner.Run()
+	if err != nil {
+		log.Printf("[%2d] Chip %d: tuning failed, using bitstream default: %v\n", board.Index, chip.ID, err)
+		return
+	}
+	var hashrate float64
+	for _, step := range steps {
+		if step.Frequency == frequency {
+			hashrate = step.Hashrate
+		}
+	}
+	log.Printf("[%2d] Chip %d: tuned to %d MHz, %.0f H/s\n", board.Index, chip.ID, frequency, hashrate)
+	err = store.Put(&TuneProfile{
+		Port:      board.Port,
+		ChipID:    chip.ID,
+		Bitstream: bitstream,
+		Frequency: frequency,
+		Hashrate:  hashrate,
+		Tuned:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("[%2d] Chip %d: unable to save profile: %v\n", board.Index, chip.ID, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ex3ndr/ai-agent/sim"
+)
+
+// simTuner is a quick autotuner of a handshaken simulated chip
+func simTuner(t *testing.T, configure func(options *sim.Options)) (*SerialChannel, *Autotuner) {
+	channel := openSim(t, configure)
+	if _, err := channel.Handshake(1); err != nil {
+		t.Fatal(err)
+	}
+	tuner := NewAutotuner(channel, 0, 1)
+	tuner.Jobs = 2
+	tuner.Iterations = 256
+	tuner.Timeout = 1
+
+	// Hashrate of short jobs is mostly latency
+	tuner.HashrateDrop = 1
+	return channel, tuner
+}
+
+func TestAutotunerAccepts(t *testing.T) {
+	tuner := NewAutotuner(nil, 0, 1)
+	stable := []TuneStep{{Frequency: 100, Jobs: 5, Hashrate: 1000, Temperature: 50}}
+	tests := []struct {
+		name   string
+		step   TuneStep
+		stable bool
+	}{
+		{"stable", TuneStep{Jobs: 5, Hashrate: 1100, Temperature: 60}, true},
+		{"small hashrate drop", TuneStep{Jobs: 5, Hashrate: 900, Temperature: 60}, true},
+		{"hashrate drop", TuneStep{Jobs: 5, Hashrate: 899, Temperature: 60}, false},
+		{"hash errors", TuneStep{Jobs: 5, Errors: 1, Hashrate: 1100, Temperature: 60}, false},
+		{"no jobs", TuneStep{Hashrate: 1100, Temperature: 60}, false},
+		{"hot", TuneStep{Jobs: 5, Hashrate: 1100, Temperature: DefaultTuneMaxTemp + 1}, false},
+	}
+	for _, test := range tests {
+		if stable := tuner.accepts(&test.step, stable); stable != test.stable {
+			t.Errorf("%s: expected %v, got %v", test.name, test.stable, stable)
+		}
+	}
+	if !tuner.accepts(&tests[1].step, nil) {
+		t.Error("first step is compared with nothing")
+	}
+
+	// Margin is counted in stable steps and never goes below the first one
+	stable = []TuneStep{{Frequency: 100}, {Frequency: 110}, {Frequency: 120}}
+	for margin, expected := range []int{120, 110, 100, 100} {
+		tuner.Margin = margin
+		if frequency := tuner.choose(stable); frequency != expected {
+			t.Errorf("margin %d: expected %d MHz, got %d", margin, expected, frequency)
+		}
+	}
+}
+
+// Frequency chip doesn't lock at is rolled back and ends tuning
+func TestAutotunerLockLimit(t *testing.T) {
+	channel, tuner := simTuner(t, func(options *sim.Options) {
+		options.LockFrequency = 300
+	})
+	tuner.MinFrequency = 250
+	frequency, steps, err := tuner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frequency != 300-10*DefaultTuneMargin || len(steps) != 6 {
+		t.Fatalf("expected %d MHz after 6 steps, got %d after %+v", 300-10*DefaultTuneMargin, frequency, steps)
+	}
+	if current, err := channel.GetFrequency(1); err != nil || current != frequency {
+		t.Fatalf("chip is left at %d MHz: %v", current, err)
+	}
+}
+
+// Chip that gets too hot is tuned below the temperature limit, temperature
+// of simulated chip grows by 1 C per 20 MHz
+func TestAutotunerTemperature(t *testing.T) {
+	_, tuner := simTuner(t, func(options *sim.Options) {
+		options.Temperature = 45
+	})
+	tuner.MinFrequency = 250
+	tuner.MaxTemperature = 55.25
+	frequency, _, err := tuner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frequency != 300-10*DefaultTuneMargin {
+		t.Fatalf("expected %d MHz, got %d", 300-10*DefaultTuneMargin, frequency)
+	}
+}
+
+// PLL is restored when no frequency is stable
+func TestAutotunerRestore(t *testing.T) {
+	channel, tuner := simTuner(t, func(options *sim.Options) {
+		options.HashErrorRate = 1
+	})
+	tuner.MinFrequency = 200
+	if _, steps, err := tuner.Run(); err == nil || len(steps) != 1 {
+		t.Fatalf("expected failure after a single step, got %+v %v", steps, err)
+	}
+	if current, err := channel.GetFrequency(1); err != nil || current != sim.DefaultOptions.Frequency {
+		t.Fatalf("chip is left at %d MHz: %v", current, err)
+	}
+}
+
+func TestProfileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	store, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuned := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	profiles := []*TuneProfile{
+		{Port: "/dev/ttyO1", ChipID: 1, Bitstream: "ai.bit:01020304", Frequency: 290, Hashrate: 1000, Tuned: tuned},
+		{Port: "/dev/ttyO1", ChipID: 2, Bitstream: "ai.bit:01020304", Frequency: 300, Hashrate: 1100, Tuned: tuned},
+		{Port: "/dev/ttyO1", ChipID: 1, Bitstream: "ai.bit:05060708", Frequency: 310, Hashrate: 1200, Tuned: tuned},
+	}
+	for _, profile := range profiles {
+		if err := store.Put(profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// File is replaced, temporary one is not left behind
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file is left: %v", err)
+	}
+
+	// Profiles are kept per port, chip and bitstream
+	reloaded, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range profiles {
+		loaded := reloaded.Get(profile.Port, profile.ChipID, profile.Bitstream)
+		if loaded == nil || *loaded != *profile {
+			t.Errorf("expected %+v, got %+v", profile, loaded)
+		}
+	}
+	if profile := reloaded.Get("/dev/ttyO2", 1, "ai.bit:01020304"); profile != nil {
+		t.Errorf("profile of another port: %+v", profile)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfiles(path); err == nil {
+		t.Fatal("broken profiles file is loaded")
+	}
+}
+
+// Tuned frequency is stored and applied from the profile after restart
+func TestApplyProfile(t *testing.T) {
+	channel, _ := simTuner(t, func(options *sim.Options) {
+		options.LockFrequency = 120
+		options.MaxIterations = 256
+		options.JobDuration = 50 * time.Millisecond
+	})
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	store, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	board := &Board{Port: "sim", Channel: channel}
+	chip := &Chip{ID: 1}
+	applyProfile(store, board, chip, "test", true)
+	if profile := store.Get("sim", 1, "test"); profile == nil || profile.Frequency != 110 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+
+	// Chip lost its clock setup, profile survives reload
+	if err := channel.SetFrequency(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyProfile(reloaded, board, chip, "test", false)
+	if current, err := channel.GetFrequency(1); err != nil || current != 110 {
+		t.Fatalf("chip is left at %d MHz: %v", current, err)
+	}
+}
@@ -1,97 +1,163 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"sync"
 	"time"
 
-	"github.com/jacobsa/go-serial/serial"
-	"github.com/sigurn/crc16"
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/xilinx"
 )
 
 type SerialChannel struct {
-	Tag         string
-	queryIdLock sync.Mutex
-	queryId     uint32
-	Closed      bool
-	RW          io.ReadWriteCloser
-	requestLock sync.Mutex
-	writeLock   sync.Mutex
-	readLock    sync.Mutex
-	callbacks   map[uint32]chan []byte
+	Tag           string
+	Closed        bool
+	RW            io.ReadWriteCloser
+	decoder       *protocol.FrameDecoder
+	capture       *Capture
+	writeLock     sync.Mutex
+	callbacksLock sync.Mutex
+	callbacks     map[uint32]chan *protocol.Frame
+	slots         map[uint32]chan struct{}
+	late          map[uint32]*lateFrame
+	listeners     map[uint32]chan *protocol.Frame
+	capabilities  map[int]*ChipCapabilities
+	families      map[int]*xilinx.Family
+	hops          map[int]int
+	jobsLock      sync.Mutex
+	jobs          map[int]*chipJobs
+	jobStats      JobStats
+	done          chan struct{}
+	err           error
 }
 
-type SerialFrame struct {
-	ChipID uint8
-	Data   []byte
+// lateFrame is a response that is still expected for an abandoned request
+type lateFrame struct {
+	deadline time.Time
+	drained  chan struct{}
 }
 
+const (
+	// DefaultRequestTimeout is used by Request when caller does not specify timeout,
+	// chips in a chain get extra time for every hop
+	DefaultRequestTimeout = 1000 * time.Millisecond
+	// LateFrameTimeout is how long a response for an abandoned request is waited for
+	// before next request to the same chip is sent
+	LateFrameTimeout = 1000 * time.Millisecond
+)
+
+// SerialOpen connects to a board. Path is either a device path or transport
+// URL as accepted by OpenTransport.
 func SerialOpen(path string, speed uint) (*SerialChannel, error) {
-	res, err := serial.Open(serial.OpenOptions{
-		PortName:              path,
-		BaudRate:              speed,
-		DataBits:              8,
-		StopBits:              1,
-		InterCharacterTimeout: 100,
-		MinimumReadSize:       0,
-		RTSCTSFlowControl:     false,
-	})
+	res, err := OpenTransport(path, speed)
 	if err != nil {
 		return nil, err
-	} else {
-		return &SerialChannel{RW: res, Closed: false, queryId: 0, callbacks: make(map[uint32]chan []byte), Tag: path}, nil
 	}
+	return newSerialChannel(res, path), nil
+}
+
+func newSerialChannel(rw io.ReadWriteCloser, tag string) *SerialChannel {
+
+	// Capture bytes before decoder drops anything
+	var reader io.Reader = rw
+	if activeCapture != nil {
+		reader = &captureReader{reader: rw, capture: activeCapture, port: tag}
+	}
+	channel := &SerialChannel{
+		RW:           rw,
+		decoder:      protocol.NewFrameDecoder(reader),
+		capture:      activeCapture,
+		Closed:       false,
+		callbacks:    make(map[uint32]chan *protocol.Frame),
+		slots:        make(map[uint32]chan struct{}),
+		late:         make(map[uint32]*lateFrame),
+		listeners:    make(map[uint32]chan *protocol.Frame),
+		capabilities: make(map[int]*ChipCapabilities),
+		families:     make(map[int]*xilinx.Family),
+		hops:         make(map[int]int),
+		jobs:         make(map[int]*chipJobs),
+		done:         make(chan struct{}),
+		Tag:          tag,
+	}
+	go channel.readLoop()
+	return channel
 }
 
 func (channel *SerialChannel) Write(chipId int, reqType uint8, data []byte) error {
 	channel.writeLock.Lock()
 	defer channel.writeLock.Unlock()
+	if channel.Closed {
+		return errors.New("port closed")
+	}
 	return channel.doWrite(chipId, reqType, data)
 }
 
-func (channel *SerialChannel) Read() (*SerialFrame, error) {
-	timer := time.NewTimer(1000 * time.Millisecond)
-	doneError := make(chan error, 1)
-	doneFrame := make(chan *SerialFrame, 1)
-	go func() {
-		channel.readLock.Lock()
-		defer channel.readLock.Unlock()
-		r, err := channel.doRead()
-		if err != nil {
-			doneError <- err
-		} else {
-			doneFrame <- r
-		}
-	}()
+func (channel *SerialChannel) Request(chipId int, reqType uint8, data []byte) (*protocol.Frame, error) {
+	return channel.RequestTimeout(chipId, reqType, data, channel.requestTimeout(chipId))
+}
+
+func (channel *SerialChannel) RequestTimeout(chipId int, reqType uint8, data []byte, timeout time.Duration) (*protocol.Frame, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return channel.RequestContext(ctx, chipId, reqType, data)
+}
+
+func (channel *SerialChannel) RequestContext(ctx context.Context, chipId int, reqType uint8, data []byte) (*protocol.Frame, error) {
+
+	// Only one request per chip and type could be in flight since responses
+	// doesn't carry anything else that could be used to match them
+	key := frameKey(uint8(chipId), reqType)
+	slot := channel.slot(key)
 	select {
-	case err := <-doneError:
+	case slot <- struct{}{}:
+	case <-channel.done:
+		return nil, channel.err
+	case <-ctx.Done():
+		return nil, requestError(ctx)
+	}
+	defer func() { <-slot }()
+
+	// Wait for response of previously abandoned request
+	if err := channel.awaitLate(ctx, key); err != nil {
 		return nil, err
-	case p := <-doneFrame:
-		return p, nil
-	case <-timer.C:
-		return nil, errors.New("Request timeout")
 	}
-}
 
-func (channel *SerialChannel) Request(chipId int, reqType uint8, data []byte) (*SerialFrame, error) {
-	channel.requestLock.Lock()
-	defer channel.requestLock.Unlock()
+	// Register callback
+	callback := make(chan *protocol.Frame, 1)
+	channel.callbacksLock.Lock()
+	channel.callbacks[key] = callback
+	channel.callbacksLock.Unlock()
 
-	// log.Printf("Request")
+	// Write request
 	err := channel.Write(chipId, reqType, data)
 	if err != nil {
+		channel.callbacksLock.Lock()
+		delete(channel.callbacks, key)
+		channel.callbacksLock.Unlock()
 		return nil, err
 	}
 
-	// log.Printf("Request read")
-	res, err := channel.Read()
-	// log.Printf("Request end")
+	// Wait for response
+	select {
+	case frame := <-callback:
+		return frame, nil
+	case <-channel.done:
+		return nil, channel.err
+	case <-ctx.Done():
+		channel.abandon(key, callback)
+		return nil, requestError(ctx)
+	}
+}
 
-	return res, err
+// DecoderStats returns counters of bytes and frames dropped while reading the port
+func (channel *SerialChannel) DecoderStats() protocol.DecoderStats {
+	return channel.decoder.Stats()
 }
 
 func (channel *SerialChannel) Close() {
@@ -109,15 +175,9 @@ func (channel *SerialChannel) Close() {
 //  SYSMON
 //////////////////////////////////////////////////////////////////////////////////////////
 
+// GetTemperature reads die temperature in degrees Celsius
 func (channel *SerialChannel) GetTemperature(chipId int) (float32, error) {
-	resp, err := channel.Request(chipId, 0x00, []byte{0x7c, 0x0e, 0x00, 0x00, 0x00})
-	if err != nil {
-		return 0, err
-	}
-
-	x := float32(binary.BigEndian.Uint16(resp.Data[1:]))
-	temp := x*502.9098/65536 - 273.819
-	return temp, nil
+	return channel.ReadSensor(chipId, &xilinx.SensorTemp)
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////
@@ -125,22 +185,67 @@ func (channel *SerialChannel) GetTemperature(chipId int) (float32, error) {
 //////////////////////////////////////////////////////////////////////////////////////////
 
 const (
-	PllWrite = 0x0A
-	PllRead  = 0x0B
-	PllLock  = 0x0C
+	PllLockTimeout      = 100 * time.Millisecond
+	PllLockPollInterval = 5 * time.Millisecond
 )
 
+type PllErrorKind int
+
+const (
+	PllWriteFailed PllErrorKind = iota
+	PllReadbackMismatch
+	PllNoLock
+)
+
+// PllError describes why PLL reconfiguration failed, RolledBack is set when
+// previous register values were restored
+type PllError struct {
+	Kind       PllErrorKind
+	ChipID     int
+	Addr       uint8
+	Expected   uint16
+	Actual     uint16
+	RolledBack bool
+	Err        error
+}
+
+func (e *PllError) Error() string {
+	var res string
+	switch e.Kind {
+	case PllWriteFailed:
+		res = fmt.Sprintf("chip %d: pll write to %02x failed: %v", e.ChipID, e.Addr, e.Err)
+	case PllReadbackMismatch:
+		res = fmt.Sprintf("chip %d: pll register %02x reads %04x instead of %04x", e.ChipID, e.Addr, e.Actual, e.Expected)
+	case PllNoLock:
+		res = fmt.Sprintf("chip %d: pll did not lock", e.ChipID)
+		if e.Err != nil {
+			res += fmt.Sprintf(": %v", e.Err)
+		}
+	}
+	if e.RolledBack {
+		res += ", rolled back"
+	}
+	return res
+}
+
+func (e *PllError) Unwrap() error {
+	return e.Err
+}
+
 func (channel *SerialChannel) PllGet(chipId int, addr uint8) (uint16, error) {
-	resp, err := channel.Request(chipId, 0xA2, []byte{PllRead, addr})
+	resp, err := channel.Request(chipId, 0xA2, []byte{protocol.PllRead, addr})
 	if err != nil {
 		return 0, err
 	}
+	if len(resp.Data) < 2 {
+		return 0, fmt.Errorf("invalid pll response: %x", resp.Data)
+	}
 	value := binary.BigEndian.Uint16(resp.Data)
 	return value, nil
 }
 
 func (channel *SerialChannel) PllSet(chipId int, addr uint8, value uint16) error {
-	req := []byte{PllWrite, addr, 0, 0}
+	req := []byte{protocol.PllWrite, addr, 0, 0}
 	binary.BigEndian.PutUint16(req[2:], value)
 	_, err := channel.Request(chipId, 0xA2, req)
 	if err != nil {
@@ -149,7 +254,7 @@ func (channel *SerialChannel) PllSet(chipId int, addr uint8, value uint16) error
 	return nil
 }
 
-func (channel *SerialChannel) PllSetMask(chipId int, cv PllConstValue) error {
+func (channel *SerialChannel) PllSetMask(chipId int, cv xilinx.PllConstValue) error {
 	oldValue, err := channel.PllGet(chipId, cv.Const.Addr)
 	if err != nil {
 		return err
@@ -161,215 +266,346 @@ func (channel *SerialChannel) PllSetMask(chipId int, cv PllConstValue) error {
 	return nil
 }
 
-func (channel *SerialChannel) PllApply(chipId int, cvs []PllConstValue, prop *XilinxProperty) error {
-	power, err := channel.PllGet(chipId, prop.PLLPowerAddr)
+// PllLocked reports lock status of MMCM, bitstreams without the query are
+// never asked
+func (channel *SerialChannel) PllLocked(chipId int) (bool, error) {
+	resp, err := channel.Request(chipId, 0xA2, []byte{protocol.PllLock})
 	if err != nil {
-		return err
+		return false, err
 	}
-	if err = channel.PllSet(chipId, prop.PLLPowerAddr, 0xFFFF); err != nil {
-		return err
+	if len(resp.Data) < 1 {
+		return false, fmt.Errorf("invalid pll lock response: %x", resp.Data)
 	}
-	for _, cv := range cvs {
-		if err = channel.PllSetMask(chipId, cv); err != nil {
-			return err
-		}
+	return resp.Data[0] != 0, nil
+}
+
+// PllApply writes register values with PLL powered down and verifies every
+// register and the lock afterwards. Previous values are restored on failure.
+func (channel *SerialChannel) PllApply(chipId int, cvs []xilinx.PllConstValue, prop *xilinx.Family) error {
+	previous := make([]xilinx.PllConstValue, 0, len(cvs))
+	err := channel.pllWrite(chipId, cvs, prop, &previous)
+	if err == nil {
+		err = channel.waitPllLock(chipId)
 	}
-	if err = channel.PllSet(chipId, prop.PLLPowerAddr, power); err != nil {
-		return err
+	if err == nil {
+		return nil
 	}
-	return nil
+
+	// Rollback
+	pllErr := err.(*PllError)
+	if len(previous) == 0 {
+		return pllErr
+	}
+	if err := channel.pllWrite(chipId, previous, prop, nil); err != nil {
+		log.Printf("[%v] Unable to roll back PLL of chip %d: %v", channel.Tag, chipId, err)
+		return pllErr
+	}
+	if err := channel.waitPllLock(chipId); err != nil {
+		log.Printf("[%v] PLL of chip %d did not lock after rollback: %v", channel.Tag, chipId, err)
+		return pllErr
+	}
+	pllErr.RolledBack = true
+	return pllErr
 }
 
-func (channel *SerialChannel) SetFrequency(chipId int, frequency int) error {
-	setup, found := Xilinx7Series.PLLFreq[frequency]
-	if !found {
+// PllPowerDown stops MMCM clock and verifies power register
+func (channel *SerialChannel) PllPowerDown(chipId int, prop *xilinx.Family) error {
+	if _, err := prop.Registers(); err != nil {
+		return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
+	}
+	return channel.pllWriteValues(chipId, []xilinx.PllConstValue{{Const: xilinx.PllConst{Addr: prop.PLLPowerAddr}, Value: 0xFFFF}}, nil)
+}
+
+// PllRestart powers stopped MMCM up with the power register value it had
+// before it was stopped and waits for the lock, the same way PllApply does.
+// MMCM is powered down again on failure.
+func (channel *SerialChannel) PllRestart(chipId int, power uint16, prop *xilinx.Family) error {
+	if _, err := prop.Registers(); err != nil {
+		return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
+	}
+	previous := make([]xilinx.PllConstValue, 0, 1)
+	err := channel.pllWriteValues(chipId, []xilinx.PllConstValue{{Const: xilinx.PllConst{Addr: prop.PLLPowerAddr}, Value: power}}, &previous)
+	if err == nil {
+		err = channel.waitPllLock(chipId)
+	}
+	if err == nil {
 		return nil
 	}
-	if err := channel.PllApply(chipId, setup, &Xilinx7Series); err != nil {
-		return err
+
+	// Rollback
+	pllErr := err.(*PllError)
+	if len(previous) == 0 {
+		return pllErr
 	}
-	return nil
+	if err := channel.pllWriteValues(chipId, previous, nil); err != nil {
+		log.Printf("[%v] Unable to power down PLL of chip %d: %v", channel.Tag, chipId, err)
+		return pllErr
+	}
+	pllErr.RolledBack = true
+	return pllErr
 }
 
-//////////////////////////////////////////////////////////////////////////////////////////
-//  Implementation
-//////////////////////////////////////////////////////////////////////////////////////////
-
-func (channel *SerialChannel) doWrite(chipId int, reqType uint8, data []byte) error {
-	packed := pack(uint8(chipId), reqType, data)
-	// log.Printf("[%v] Write: %x: %d|%d|%x", channel.Tag, packed, chipId, reqType, data)
-	n, err := channel.RW.Write(packed)
+// pllWrite writes and reads back values, register values before the write are
+// collected to previous if it is not nil. Power is restored even if a write
+// failed. Families without known register map are never written.
+func (channel *SerialChannel) pllWrite(chipId int, cvs []xilinx.PllConstValue, prop *xilinx.Family, previous *[]xilinx.PllConstValue) error {
+	if _, err := prop.Registers(); err != nil {
+		return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
+	}
+	power, err := channel.PllGet(chipId, prop.PLLPowerAddr)
 	if err != nil {
-		return err
+		return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
 	}
-	if n != len(packed) {
-		return errors.New("UART wirte issue")
+	if err = channel.PllSet(chipId, prop.PLLPowerAddr, 0xFFFF); err != nil {
+		return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
+	}
+	res := channel.pllWriteValues(chipId, cvs, previous)
+	if err = channel.PllSet(chipId, prop.PLLPowerAddr, power); err != nil && res == nil {
+		res = &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: prop.PLLPowerAddr, Err: err}
+	}
+	return res
+}
+
+func (channel *SerialChannel) pllWriteValues(chipId int, cvs []xilinx.PllConstValue, previous *[]xilinx.PllConstValue) error {
+	seen := make(map[uint8]bool)
+	for _, cv := range cvs {
+		addr := cv.Const.Addr
+		oldValue, err := channel.PllGet(chipId, addr)
+		if err != nil {
+			return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: addr, Err: err}
+		}
+
+		// Only the first value is original when a register is written twice
+		if previous != nil && !seen[addr] {
+			*previous = append(*previous, xilinx.PllConstValue{Const: xilinx.PllConst{Addr: addr, Mask: 0}, Value: oldValue})
+			seen[addr] = true
+		}
+
+		newValue := (oldValue & cv.Const.Mask) | (cv.Value & ^cv.Const.Mask)
+		if err = channel.PllSet(chipId, addr, newValue); err != nil {
+			return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: addr, Err: err}
+		}
+		value, err := channel.PllGet(chipId, addr)
+		if err != nil {
+			return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: addr, Err: err}
+		}
+		if value != newValue {
+			return &PllError{Kind: PllReadbackMismatch, ChipID: chipId, Addr: addr, Expected: newValue, Actual: value}
+		}
 	}
 	return nil
 }
 
-func (channel *SerialChannel) doRead() (*SerialFrame, error) {
-	var buffer bytes.Buffer
-	var buffer2 bytes.Buffer
-	b := make([]byte, 1)
+// waitPllLock polls lock status until MMCM is locked, chips without the lock
+// query are assumed to be locked
+func (channel *SerialChannel) waitPllLock(chipId int) error {
+	if !channel.Capabilities(chipId).Supports(protocol.FeaturePllLock) {
+		return nil
+	}
+	deadline := time.Now().Add(PllLockTimeout)
 	for {
-		n, err := channel.RW.Read(b)
-		switch err {
-		case io.EOF:
-			continue
-		case nil:
-		default:
-			return nil, err
+		locked, err := channel.PllLocked(chipId)
+		if err != nil {
+			return &PllError{Kind: PllNoLock, ChipID: chipId, Err: err}
 		}
-		if n != 1 {
-			continue
+		if locked {
+			return nil
 		}
-		// log.Printf("Received: %02x", b[0])
-		buffer2.WriteByte(b[0])
-
-		switch b[0] {
-		case STX:
-			buffer.Reset()
-		case ETX:
-			// log.Printf("Frame (0): %02x", buffer.Bytes())
-			// log.Printf("Frame (r): %02x", buffer2.Bytes())
-			frm, err := unserialize(buffer.Bytes())
-			if err != nil {
-				return nil, err
-			}
-			// log.Printf("Frame: %02x", frm.Data)
-			return frm, nil
-		case ESC:
-			for {
-				n, err := channel.RW.Read(b)
-				switch err {
-				case io.EOF:
-					continue
-				case nil:
-				default:
-					return nil, err
-				}
-				if n != 1 {
-					continue
-				}
-				buffer2.WriteByte(b[0])
-				break
-			}
-			// log.Printf("Received: %02x", b[0])
-			fallthrough
-		default:
-			buffer.WriteByte(b[0])
+		if time.Now().After(deadline) {
+			return &PllError{Kind: PllNoLock, ChipID: chipId}
 		}
+		time.Sleep(PllLockPollInterval)
 	}
 }
 
-const (
-	STX                  byte = 0x02
-	ETX                  byte = 0x03
-	ESC                  byte = 0x1B
-	PacketHeaderLength        = 5
-	PacketChecksumLength      = 2
-)
-
-func escape(data []byte) []byte {
-	var buf bytes.Buffer
-	for _, b := range data {
-		switch b {
-		case STX:
-			fallthrough
-		case ESC:
-			fallthrough
-		case ETX:
-			buf.WriteByte(ESC)
-			fallthrough
-		default:
-			buf.WriteByte(b)
-		}
+// SetFrequency sets chip clock in MHz, error is returned for frequencies that
+// could not be reached
+func (channel *SerialChannel) SetFrequency(chipId int, frequency int) error {
+	prop := channel.Family(chipId)
+	setup, err := prop.Setup(frequency)
+	if err != nil {
+		return err
+	}
+	if err := channel.PllApply(chipId, setup, prop); err != nil {
+		return err
 	}
-	return buf.Bytes()
+	return nil
 }
 
-func calcChecksum(data []byte) []byte {
-	arr := make([]byte, 2)
-	table := crc16.MakeTable(crc16.CRC16_ARC)
-	checksum := crc16.Checksum(data, table)
-	binary.BigEndian.PutUint16(arr, checksum)
-	return arr
+// GetFrequency decodes chip clock in MHz from MMCM registers
+func (channel *SerialChannel) GetFrequency(chipId int) (int, error) {
+	prop := channel.Family(chipId)
+	values, err := channel.PllSnapshot(chipId, prop)
+	if err != nil {
+		return 0, err
+	}
+	registers := make(map[uint8]uint16)
+	for _, cv := range values {
+		registers[cv.Const.Addr] = cv.Value
+	}
+	config, err := xilinx.DecodeMmcm(prop, registers)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(config.Frequency(prop.InputFrequency))), nil
 }
 
-type packetHeader struct {
-	Version uint8
-	Type    uint8
-	ID      uint8
-	Length  uint16
+//////////////////////////////////////////////////////////////////////////////////////////
+//  Implementation
+//////////////////////////////////////////////////////////////////////////////////////////
+
+func frameKey(chipId uint8, reqType uint8) uint32 {
+	return uint32(chipId)<<8 | uint32(reqType)
 }
 
-func pack(id uint8, requestType uint8, data []byte) []byte {
+func (channel *SerialChannel) slot(key uint32) chan struct{} {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	s, found := channel.slots[key]
+	if !found {
+		s = make(chan struct{}, 1)
+		channel.slots[key] = s
+	}
+	return s
+}
 
-	// Frame
-	header := packetHeader{
-		Version: 0,
-		Type:    requestType,
-		ID:      id,
-		Length:  uint16(len(data)),
+// Listen registers a channel for frames of given type sent by chip without
+// request. Frames are dropped when listener is not keeping up.
+func (channel *SerialChannel) Listen(chipId int, reqType uint8, size int) chan *protocol.Frame {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	key := frameKey(uint8(chipId), reqType)
+	listener, found := channel.listeners[key]
+	if !found {
+		listener = make(chan *protocol.Frame, size)
+		channel.listeners[key] = listener
 	}
-	var payload bytes.Buffer
-	binary.Write(&payload, binary.BigEndian, &header)
-	payload.Write(data)
-	payload.Write(calcChecksum(payload.Bytes()))
-	body := payload.Bytes()
-	body = escape(body)
+	return listener
+}
 
-	// Transfer package
-	var res bytes.Buffer
-	res.WriteByte(STX)
-	res.Write(body)
-	res.WriteByte(ETX)
-	return res.Bytes()
+func (channel *SerialChannel) listener(chipId int, reqType uint8) chan *protocol.Frame {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	return channel.listeners[frameKey(uint8(chipId), reqType)]
 }
 
-func parsePacket(p []byte) (*SerialFrame, error) {
-	// check length
-	if len(p) < PacketHeaderLength {
-		return nil, fmt.Errorf("invalid parsing: %x", p)
+// abandon unregisters callback of a request that is not waited anymore. If response
+// was not delivered yet it is expected to arrive later and has to be discarded.
+func (channel *SerialChannel) abandon(key uint32, callback chan *protocol.Frame) {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	if channel.callbacks[key] != callback {
+		return
 	}
-	// parse header
-	hdr := packetHeader{}
-	headerBuf := bytes.NewBuffer(p[:PacketHeaderLength])
-	binary.Read(headerBuf, binary.BigEndian, &hdr)
-	data := p[PacketHeaderLength:]
-	if len(data) != int(hdr.Length) {
-		return nil, fmt.Errorf("invalid parsing: %x", p)
+	delete(channel.callbacks, key)
+	channel.late[key] = &lateFrame{deadline: time.Now().Add(LateFrameTimeout), drained: make(chan struct{})}
+}
+
+func (channel *SerialChannel) awaitLate(ctx context.Context, key uint32) error {
+	channel.callbacksLock.Lock()
+	late, found := channel.late[key]
+	channel.callbacksLock.Unlock()
+	if !found {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(late.deadline))
+	defer timer.Stop()
+	select {
+	case <-late.drained:
+		return nil
+	case <-timer.C:
+		channel.callbacksLock.Lock()
+		if channel.late[key] == late {
+			delete(channel.late, key)
+		}
+		channel.callbacksLock.Unlock()
+		return nil
+	case <-channel.done:
+		return channel.err
+	case <-ctx.Done():
+		return requestError(ctx)
 	}
-	res := SerialFrame{ChipID: hdr.ID, Data: data}
-	return &res, nil
 }
 
-func unserialize(p []byte) (*SerialFrame, error) {
-	// check crc first
-	payload, err := popCRC(p)
-	if err != nil {
-		return nil, err
+// ErrRequestTimeout is returned when chip didn't answer in time
+var ErrRequestTimeout = errors.New("request timeout")
+
+func requestError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrRequestTimeout
 	}
-	// parse header + check data
-	res, err := parsePacket(payload)
-	if err != nil {
-		return nil, err
+	return ctx.Err()
+}
+
+func (channel *SerialChannel) readLoop() {
+	for {
+		frame, err := channel.decoder.Next()
+		if err != nil {
+			channel.writeLock.Lock()
+			closed := channel.Closed
+			channel.writeLock.Unlock()
+			if closed {
+				channel.err = errors.New("port closed")
+			} else {
+				channel.err = fmt.Errorf("port failed: %v", err)
+			}
+			close(channel.done)
+			return
+		}
+		if channel.capture != nil {
+			channel.capture.Record(channel.Tag, CaptureRx, frame, nil)
+		}
+
+		// Route frame to the waiting caller
+		key := frameKey(frame.ChipID, frame.Type)
+		channel.callbacksLock.Lock()
+		callback, found := channel.callbacks[key]
+		if found {
+			delete(channel.callbacks, key)
+		}
+		late, isLate := channel.late[key]
+		if !found && isLate {
+			delete(channel.late, key)
+			close(late.drained)
+		}
+		listener, isListened := channel.listeners[key]
+		channel.callbacksLock.Unlock()
+
+		// Unsolicited frames
+		if !found && !isLate && isListened {
+			select {
+			case listener <- frame:
+			default:
+				log.Printf("[%v] Dropped event from %d, listener is full: %x", channel.Tag, frame.ChipID, frame.Data)
+			}
+			continue
+		}
+
+		if !found {
+			if isLate {
+				log.Printf("[%v] Discarded late frame from %d: %x", channel.Tag, frame.ChipID, frame.Data)
+			} else {
+				log.Printf("[%v] Dropped unexpected frame from %d: %x", channel.Tag, frame.ChipID, frame.Data)
+			}
+			continue
+		}
+		callback <- frame
 	}
-	return res, nil
 }
 
-func popCRC(p []byte) ([]byte, error) {
-	// check length
-	if len(p) < PacketChecksumLength {
-		return nil, fmt.Errorf("invalid packet: %x", p)
+func (channel *SerialChannel) doWrite(chipId int, reqType uint8, data []byte) error {
+	packed := protocol.Pack(uint8(chipId), reqType, data)
+	// log.Printf("[%v] Write: %x: %d|%d|%x", channel.Tag, packed, chipId, reqType, data)
+	if channel.capture != nil {
+		channel.capture.Record(channel.Tag, CaptureTx, &protocol.Frame{ChipID: uint8(chipId), Type: reqType, Data: data}, packed)
+	}
+	n, err := channel.RW.Write(packed)
+	if err != nil {
+		return err
 	}
-	pcrc := len(p) - PacketChecksumLength
-	payload := p[:pcrc]
-	checksum := p[pcrc:]
-	// checksum
-	if !bytes.Equal(checksum, calcChecksum(payload)) {
-		return nil, fmt.Errorf("checksum failed expected %x, got %x. data: %x", calcChecksum(payload), checksum, p)
+	if n != len(packed) {
+		return errors.New("UART wirte issue")
 	}
-	return payload, nil
+	return nil
 }
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"time"
+
+	"github.com/ex3ndr/ai-agent/protocol"
+	"github.com/ex3ndr/ai-agent/xilinx"
 )
 
-func (channel *SerialChannel) PerformJob(chipId int, data []byte, timeoutDuration int) ([]byte, error) {
+func (channel *SerialChannel) PerformJob(ctx context.Context, chipId int, command uint8, data []byte, timeoutDuration int) ([]byte, error) {
+	queryId, err := channel.SubmitJob(chipId, command, data)
+	if err != nil {
+		return nil, err
+	}
+	return channel.WaitJob(ctx, chipId, queryId, timeoutDuration)
+}
+
+// SubmitJob sends job to the chip and returns its ID, chip drops the job it
+// was working on. Command is either JobSubmit or JobSubmitTarget.
+func (channel *SerialChannel) SubmitJob(chipId int, command uint8, data []byte) (uint32, error) {
 
 	// Job ID
-	channel.queryIdLock.Lock()
-	queryId := (channel.queryId + 1) % 256
-	channel.queryId = queryId
-	channel.queryIdLock.Unlock()
-	statusCheck := []byte{0x9a}
+	queryId := channel.nextJob(chipId)
 
 	// Preflight check
 	// res, err := channel.Request(chipId, 0x0, statusCheck)
@@ -26,15 +37,51 @@ func (channel *SerialChannel) PerformJob(chipId int, data []byte, timeoutDuratio
 	// }
 
 	// Package
-	job := []byte{0x8c}
+	job := []byte{command}
 	tmp := make([]byte, 4)
 	binary.BigEndian.PutUint32(tmp, queryId)
 	job = append(job, tmp...)
 	job = append(job, data...)
 	err := channel.Write(chipId, 0x00, job)
 	if err != nil {
-		return nil, err
+		channel.finishJob(chipId, queryId, false)
+		return 0, err
 	}
+	return queryId, nil
+}
+
+const (
+	// JobPollInterval is a delay between status checks
+	JobPollInterval = 100 * time.Millisecond
+	// JobEventPollInterval is a delay between status checks when chip pushes
+	// completion, checks are only needed to recover a lost event
+	JobEventPollInterval = 5 * time.Second
+)
+
+// ErrJobAborted is returned when job was cancelled before completion
+var ErrJobAborted = errors.New("job aborted")
+
+// WaitJob waits until job is completed and returns raw job result. Chips that
+// push completion events are waited for an event, others are polled. When
+// context is cancelled chip is asked to drop the job.
+func (channel *SerialChannel) WaitJob(ctx context.Context, chipId int, queryId uint32, timeoutDuration int) ([]byte, error) {
+	var res []byte
+	var err error
+	if events := channel.listener(chipId, protocol.JobEventType); events != nil {
+		res, err = channel.waitJobEvent(ctx, chipId, queryId, events, timeoutDuration)
+	} else {
+		res, err = channel.pollJob(ctx, chipId, queryId, timeoutDuration)
+	}
+	channel.finishJob(chipId, queryId, err == nil)
+	if err == ErrJobAborted {
+		if abortErr := channel.AbortJob(chipId); abortErr != nil {
+			log.Printf("[%v] Unable to abort job %d of chip %d: %v", channel.Tag, queryId, chipId, abortErr)
+		}
+	}
+	return res, err
+}
+
+func (channel *SerialChannel) pollJob(ctx context.Context, chipId int, queryId uint32, timeoutDuration int) ([]byte, error) {
 
 	// Check job
 	start := time.Now()
@@ -45,45 +92,306 @@ func (channel *SerialChannel) PerformJob(chipId int, data []byte, timeoutDuratio
 			return nil, errors.New("job timeout")
 		}
 
-		// Retry every 200 ms
-		time.Sleep(100 * time.Millisecond)
+		// Retry every 100 ms
+		select {
+		case <-time.After(JobPollInterval):
+		case <-ctx.Done():
+			return nil, ErrJobAborted
+		}
 
 		// Do check
-		res, err := channel.Request(chipId, 0x0, statusCheck)
+		data, ready, err := channel.checkJob(chipId, queryId)
 		if err != nil {
 			return nil, err
 		}
-		if len(res.Data) == 0 {
-			return nil, errors.New("invalid frame")
+		if ready {
+			return data, nil
 		}
+	}
+}
 
-		// No job
-		jobState := res.Data[0]
-		data := res.Data[1:]
-		if jobState == 0 {
-			return nil, errors.New("no job found")
+func (channel *SerialChannel) waitJobEvent(ctx context.Context, chipId int, queryId uint32, events chan *protocol.Frame, timeoutDuration int) ([]byte, error) {
+	timeout := time.NewTimer(time.Duration(timeoutDuration) * time.Second)
+	defer timeout.Stop()
+	poll := time.NewTicker(JobEventPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case frame := <-events:
+			jobState, receivedJobId, data, err := parseJobStatus(frame.Data)
+			if err != nil {
+				log.Printf("[%v] Invalid job event from %d: %v", channel.Tag, chipId, err)
+				continue
+			}
+			if channel.matchJob(chipId, receivedJobId, queryId) != jobCurrent {
+				continue
+			}
+			if jobState == protocol.JobStateReady {
+				return data, nil
+			}
+		case <-poll.C:
+			// Event could be lost
+			data, ready, err := channel.checkJob(chipId, queryId)
+			if err != nil {
+				return nil, err
+			}
+			if ready {
+				return data, nil
+			}
+		case <-timeout.C:
+			return nil, errors.New("job timeout")
+		case <-ctx.Done():
+			return nil, ErrJobAborted
+		case <-channel.done:
+			return nil, channel.err
 		}
+	}
+}
+
+// checkJob requests job status and returns result if job is ready
+func (channel *SerialChannel) checkJob(chipId int, queryId uint32) ([]byte, bool, error) {
+	res, err := channel.Request(chipId, 0x0, []byte{0x9a})
+	if err != nil {
+		return nil, false, err
+	}
+	jobState, receivedJobId, data, err := parseJobStatus(res.Data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Chip still reporting an earlier job never received the awaited one,
+	// unknown IDs are line noise and next check could succeed
+	switch channel.matchJob(chipId, receivedJobId, queryId) {
+	case jobSuperseded:
+		return nil, false, ErrJobLost
+	case jobUnknown:
+		return nil, false, nil
+	}
+	return data, jobState == protocol.JobStateReady, nil
+}
+
+// parseJobStatus parses status response or completion event: job state, job
+// ID and result for ready jobs
+func parseJobStatus(frame []byte) (uint8, uint32, []byte, error) {
+	if len(frame) == 0 {
+		return 0, 0, nil, errors.New("invalid frame")
+	}
+
+	// No job
+	jobState := frame[0]
+	data := frame[1:]
+	if jobState == protocol.JobStateIdle {
+		return 0, 0, nil, errors.New("no job found")
+	}
+	if jobState != protocol.JobStateWorking && jobState != protocol.JobStateReady {
+		return 0, 0, nil, errors.New("invalid job state")
+	}
+
+	// Parse package
+	if len(data) < 4 {
+		return 0, 0, nil, errors.New("invalid frame")
+	}
+	receivedJobId := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	return jobState, receivedJobId, data, nil
+}
+
+// AbortJob stops current job of a chip. Bitstreams without abort support keep
+// working until the next job is submitted.
+func (channel *SerialChannel) AbortJob(chipId int) error {
+	if !channel.Capabilities(chipId).Supports(protocol.FeatureJobAbort) {
+		return nil
+	}
+	frame, err := channel.Request(chipId, 0x00, []byte{protocol.JobAbort})
+	if err != nil {
+		return err
+	}
+	if len(frame.Data) != 2 || frame.Data[0] != protocol.JobAbort || frame.Data[1] != protocol.JobStateIdle {
+		return fmt.Errorf("invalid abort response: %x", frame.Data)
+	}
+	return nil
+}
+
+// EnableJobEvents switches chip to push job completion if bitstream supports it
+func (channel *SerialChannel) EnableJobEvents(chipId int) (bool, error) {
+	if !channel.Capabilities(chipId).Supports(protocol.FeatureJobEvents) {
+		return false, nil
+	}
+	frame, err := channel.Request(chipId, 0xA2, []byte{protocol.ChipConfigJobEvents, 1})
+	if err != nil {
+		return false, err
+	}
+	if len(frame.Data) != 1 || frame.Data[0] != 1 {
+		return false, fmt.Errorf("chip refused job events: %x", frame.Data)
+	}
+	channel.Listen(chipId, protocol.JobEventType, 4)
+	return true, nil
+}
 
-		// Parse package
-		receivedJobId := binary.BigEndian.Uint32(data)
-		data = data[4:]
+//////////////////////////////////////////////////////////////////////////////////////////
+//  Chain
+//////////////////////////////////////////////////////////////////////////////////////////
+
+//
+// Chain bitstreams forward every frame that is not addressed to the chip to
+// the next chip in the chain, so a single UART drives all of them. Chips start
+// without address and take one from the first assign command they see, the
+// following assign commands are forwarded down the chain. Frames to the
+// broadcast address are executed by every chip and never answered.
+//
+
+const (
+	// ChainHopTimeout is added to request timeout for every chip a frame passes
+	ChainHopTimeout = 50 * time.Millisecond
+	// MaxChainLength is limited by the addresses available in a frame
+	MaxChainLength = protocol.BroadcastChipID - 1
+)
 
-		// Check job id
-		if receivedJobId != queryId {
-			return nil, fmt.Errorf("job mismatch. expected: %d, got: %d", queryId, receivedJobId)
+// EnumerateChain resets addresses of all chips and assigns addresses starting
+// from 1 in chain order. Returns number of chips in the chain.
+func (channel *SerialChannel) EnumerateChain(maxLength int) (int, error) {
+	if maxLength > MaxChainLength {
+		maxLength = MaxChainLength
+	}
+
+	// Drop previous assignment
+	if err := channel.Broadcast(0xA2, []byte{protocol.ChainReset}); err != nil {
+		return 0, err
+	}
+	channel.setHops(make(map[int]int))
+
+	hops := make(map[int]int)
+	for address := 1; address <= maxLength; address++ {
+
+		// First chip without address takes it
+		if err := channel.Write(protocol.UnassignedChipID, 0xA2, []byte{protocol.ChainAssign, uint8(address)}); err != nil {
+			return 0, err
 		}
 
-		// Job not ready
-		if jobState == 1 {
-			continue
+		// Check that chip responds on new address, frame passes
+		// address-1 chips in each direction
+		hops[address] = address - 1
+		timeout := DefaultRequestTimeout + time.Duration(2*hops[address])*ChainHopTimeout
+		if _, err := channel.RequestTimeout(address, 0x00, []byte{0x9a}, timeout); err != nil {
+			delete(hops, address)
+			break
 		}
+	}
+	channel.setHops(hops)
+	return len(hops), nil
+}
 
-		// Job ready
-		if jobState == 2 {
-			return data, nil
+// Broadcast sends frame to every chip of the chain
+func (channel *SerialChannel) Broadcast(reqType uint8, data []byte) error {
+	return channel.Write(protocol.BroadcastChipID, reqType, data)
+}
+
+// BroadcastFrequency sets frequency of every chip in the chain. Chips are
+// expected to run the same bitstream, so current register values are read from
+// the reference chip only and the result is verified on it. Previous values are
+// broadcast back on failure.
+func (channel *SerialChannel) BroadcastFrequency(referenceChipId int, frequency int) error {
+	prop := channel.Family(referenceChipId)
+	setup, err := prop.Setup(frequency)
+	if err != nil {
+		return err
+	}
+
+	// Read current values
+	power, err := channel.PllGet(referenceChipId, prop.PLLPowerAddr)
+	if err != nil {
+		return err
+	}
+	addrs := make([]uint8, len(setup))
+	previous := make([]uint16, len(setup))
+	values := make([]uint16, len(setup))
+	for i, cv := range setup {
+		oldValue, err := channel.PllGet(referenceChipId, cv.Const.Addr)
+		if err != nil {
+			return err
 		}
+		addrs[i] = cv.Const.Addr
+		previous[i] = oldValue
+		values[i] = (oldValue & cv.Const.Mask) | (cv.Value & ^cv.Const.Mask)
+	}
 
-		// Invalid state
-		return nil, errors.New("invalid job state")
+	// Write to all chips
+	if err = channel.broadcastPllValues(prop, addrs, values, power); err != nil {
+		return &PllError{Kind: PllWriteFailed, ChipID: referenceChipId, Err: err}
+	}
+	pllErr := channel.verifyPll(referenceChipId, addrs, values)
+	if pllErr == nil {
+		return nil
 	}
+
+	// Rollback
+	if err := channel.broadcastPllValues(prop, addrs, previous, power); err != nil {
+		log.Printf("[%v] Unable to roll back PLL of chain: %v", channel.Tag, err)
+		return pllErr
+	}
+	if err := channel.waitPllLock(referenceChipId); err != nil {
+		log.Printf("[%v] PLL of chain did not lock after rollback: %v", channel.Tag, err)
+		return pllErr
+	}
+	pllErr.RolledBack = true
+	return pllErr
+}
+
+func (channel *SerialChannel) broadcastPllValues(prop *xilinx.Family, addrs []uint8, values []uint16, power uint16) error {
+	if err := channel.broadcastPll(prop.PLLPowerAddr, 0xFFFF); err != nil {
+		return err
+	}
+	for i, addr := range addrs {
+		if err := channel.broadcastPll(addr, values[i]); err != nil {
+			return err
+		}
+	}
+	return channel.broadcastPll(prop.PLLPowerAddr, power)
+}
+
+// verifyPll reads back values written by broadcast and waits for the lock.
+// Only the last value of a register written twice is expected.
+func (channel *SerialChannel) verifyPll(chipId int, addrs []uint8, values []uint16) *PllError {
+	expected := make(map[uint8]uint16)
+	for i, addr := range addrs {
+		expected[addr] = values[i]
+	}
+	for _, addr := range addrs {
+		value, err := channel.PllGet(chipId, addr)
+		if err != nil {
+			return &PllError{Kind: PllWriteFailed, ChipID: chipId, Addr: addr, Err: err}
+		}
+		if value != expected[addr] {
+			return &PllError{Kind: PllReadbackMismatch, ChipID: chipId, Addr: addr, Expected: expected[addr], Actual: value}
+		}
+	}
+	if err := channel.waitPllLock(chipId); err != nil {
+		return err.(*PllError)
+	}
+	return nil
+}
+
+func (channel *SerialChannel) broadcastPll(addr uint8, value uint16) error {
+	req := []byte{protocol.PllWrite, addr, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], value)
+	return channel.Broadcast(0xA2, req)
+}
+
+// requestTimeout is the default timeout adjusted for position of chip in chain
+func (channel *SerialChannel) requestTimeout(chipId int) time.Duration {
+	return DefaultRequestTimeout + channel.hopDelay(chipId)
+}
+
+// hopDelay is the time a frame and its response spend passing chips in front
+// of the addressed one
+func (channel *SerialChannel) hopDelay(chipId int) time.Duration {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	return time.Duration(2*channel.hops[chipId]) * ChainHopTimeout
+}
+
+func (channel *SerialChannel) setHops(hops map[int]int) {
+	channel.callbacksLock.Lock()
+	defer channel.callbacksLock.Unlock()
+	channel.hops = hops
 }
@@ -0,0 +1,140 @@
+package work
+
+import (
+	"context"
+	"encoding/binary"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+//
+// Search runs a job on CPU the way chip does: nonces start from the first one
+// of the job, every nonce is hashed with midstate of every prefix and results
+// are encoded as chip reports them, so they are verified the same way.
+// Nonces are split between threads in equal ranges.
+//
+
+// cancelInterval is the number of nonces between context checks
+const cancelInterval = 4096
+
+type result struct {
+	hash   Digest
+	nonce  uint32
+	prefix int
+}
+
+// Search runs the job on threads, all cores when threads is not positive
+func (job *Job) Search(ctx context.Context, threads int) ([]byte, error) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	if uint32(threads) > job.Iterations {
+		threads = int(job.Iterations)
+	}
+
+	// Job without target reports only the minimum
+	limit := 1
+	var target *Digest
+	if job.Target != nil {
+		limit = int(job.MaxResults)
+		t := ParseDigest(job.Target)
+		target = &t
+	}
+
+	found := make([][]result, threads)
+	first := job.FirstNonce()
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		from := uint32(uint64(job.Iterations) * uint64(t) / uint64(threads))
+		to := uint32(uint64(job.Iterations) * uint64(t+1) / uint64(threads))
+		wg.Add(1)
+		go func(t int) {
+			defer wg.Done()
+			found[t] = job.search(ctx, first+from, to-from, target, limit)
+		}(t)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]result, 0, threads*limit)
+	for _, f := range found {
+		res = append(res, f...)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].less(&res[j]) })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return encodeResults(res, target != nil), nil
+}
+
+// search keeps up to limit best results of a range of nonces sorted by hash
+func (job *Job) search(ctx context.Context, nonce uint32, count uint32, target *Digest, limit int) []result {
+	block := append([]byte(nil), job.Suffix...)
+	res := make([]result, 0, limit)
+	for i := uint32(0); i < count; i++ {
+		if i%cancelInterval == 0 && ctx.Err() != nil {
+			return nil
+		}
+		n := nonce + i
+		binary.BigEndian.PutUint32(block[0:], n)
+		binary.BigEndian.PutUint32(block[nonceOffset:], n)
+		for p := range job.Midstates {
+			d := job.Midstates[p]
+			blockGeneric(&d, block)
+			blockGeneric(&d, tail)
+			if target != nil && target.less(&d) {
+				continue
+			}
+			if len(res) == limit && (limit == 0 || !d.less(&res[limit-1].hash)) {
+				continue
+			}
+			at := sort.Search(len(res), func(k int) bool { return d.less(&res[k].hash) })
+			if len(res) < limit {
+				res = append(res, result{})
+			}
+			copy(res[at+1:], res[at:])
+			res[at] = result{hash: d, nonce: n, prefix: p}
+		}
+	}
+	return res
+}
+
+// encodeResults builds chip response: a single result, or a count followed by
+// results for a job with target
+func encodeResults(res []result, withTarget bool) []byte {
+	data := make([]byte, 0, 1+len(res)*ResultSize)
+	if withTarget {
+		data = append(data, uint8(len(res)))
+	}
+	entry := make([]byte, 8)
+	for _, r := range res {
+		data = append(data, r.hash.Bytes()...)
+		binary.BigEndian.PutUint32(entry[0:], r.nonce)
+		binary.BigEndian.PutUint32(entry[4:], uint32(r.prefix))
+		data = append(data, entry...)
+	}
+	return data
+}
+
+func (r *result) less(o *result) bool {
+	if r.hash != o.hash {
+		return r.hash.less(&o.hash)
+	}
+	if r.nonce != o.nonce {
+		return r.nonce < o.nonce
+	}
+	return r.prefix < o.prefix
+}
+
+// less compares states as big endian numbers
+func (d *Digest) less(o *Digest) bool {
+	for i := range d.h {
+		if d.h[i] != o.h[i] {
+			return d.h[i] < o.h[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package work
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+// cpuJob is a job over a non-zero block, so the first nonce is not zero
+func cpuJob(t testing.TB, iterations uint32) *Job {
+	data := make([]byte, DataSize)
+	for i := range data {
+		data[i] = byte(i*13 + 1)
+	}
+	job, err := FromData(data, 4, iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// bruteForce hashes every nonce and prefix of a job one by one
+func bruteForce(job *Job) []byte {
+	res := make([]result, 0)
+	first := job.FirstNonce()
+	for i := uint32(0); i < job.Iterations; i++ {
+		for p := range job.Midstates {
+			hash := job.Hash(p, first+i)
+			if job.Target != nil && !IsShare(hash, job.Target) {
+				continue
+			}
+			res = append(res, result{hash: ParseDigest(hash), nonce: first + i, prefix: p})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].less(&res[j]) })
+	limit := 1
+	if job.Target != nil {
+		limit = int(job.MaxResults)
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return encodeResults(res, job.Target != nil)
+}
+
+func TestSearch(t *testing.T) {
+	target := make([]byte, 32)
+	target[0] = 0x20
+	tests := []struct {
+		name       string
+		iterations uint32
+		target     []byte
+		maxResults uint8
+	}{
+		{"minimum", 1000, nil, 0},
+		{"more threads than nonces", 2, nil, 0},
+		{"target", 1000, target, 8},
+		{"every share", 200, target, 255},
+		{"no results", 200, target, 0},
+	}
+	for _, test := range tests {
+		job := cpuJob(t, test.iterations)
+		job.Target = test.target
+		job.MaxResults = test.maxResults
+		expected := bruteForce(job)
+		for _, threads := range []int{1, 3, 7, 0} {
+			res, err := job.Search(context.Background(), threads)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res, expected) {
+				t.Errorf("%s, %d threads: expected %x, got %x", test.name, threads, expected, res)
+			}
+			if test.target != nil {
+				if _, err := job.VerifyAll(res); err != nil {
+					t.Errorf("%s, %d threads: %v", test.name, threads, err)
+				}
+			} else if _, err := job.Verify(res); err != nil {
+				t.Errorf("%s, %d threads: %v", test.name, threads, err)
+			}
+		}
+	}
+}
+
+func TestSearchCancel(t *testing.T) {
+	job := cpuJob(t, 1<<30)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := job.Search(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// BenchmarkSearch measures hashrate on all cores
+func BenchmarkSearch(b *testing.B) {
+	job := cpuJob(b, 1<<14)
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := job.Search(context.Background(), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+	hashes := float64(b.N) * float64(job.Iterations) * float64(len(job.Midstates))
+	b.ReportMetric(hashes/time.Since(start).Seconds(), "H/s")
+}
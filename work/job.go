@@ -0,0 +1,222 @@
+package work
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+//
+// Job is a search over a 123 byte block of pool header, random, seed and the
+// same random again. The first 64 bytes are a prefix that is hashed once into
+// a midstate, chips hash the rest with a nonce written over the first and the
+// 48th byte of it, which are both inside of the random. Every core of a chip
+// has own prefix with expires field decremented by its index, so a job covers
+// a number of expires values at once.
+//
+
+const (
+	DataSize   = 123
+	PrefixSize = 64
+	RandomSize = 32
+
+	// ResultSize is a hash, a nonce and a prefix index reported by chip
+	ResultSize = 32 + 4 + 4
+)
+
+// Offsets of fields in the block: expires is in the header, nonce is spliced
+// into suffix and the random that follows it
+const (
+	expiresOffset = 7
+	randomOffset  = 27
+	nonceOffset   = 48
+)
+
+// tail is the last block, it only holds the message length
+var tail = func() []byte {
+	res := make([]byte, 64)
+	binary.BigEndian.PutUint64(res[56:], DataSize*8)
+	return res
+}()
+
+type Job struct {
+	Iterations uint32
+	Expires    uint32
+	Prefixes   [][]byte
+	Midstates  []Digest
+
+	// Suffix is the padded second block, nonce of a chip starts from its
+	// first bytes. Random is the one at the end of the block.
+	Suffix []byte
+	Random []byte
+
+	// Chip reports up to MaxResults hashes not above Target when it is set and
+	// only the minimum one otherwise
+	Target     []byte
+	MaxResults uint8
+}
+
+// Share is a hash found by a job with random and expires reproducing it
+type Share struct {
+	Random  []byte
+	Value   []byte
+	Expires uint32
+	Prefix  int
+	Nonce   uint32
+}
+
+// Data builds a block from pool header, seed and random
+func Data(header []byte, random []byte, seed []byte) []byte {
+	data := make([]byte, 0, DataSize)
+	data = append(data, header...)
+	data = append(data, random...)
+	data = append(data, seed...)
+	data = append(data, random...)
+	return data
+}
+
+func NewJob(header []byte, random []byte, seed []byte, prefixes int, iterations uint32) (*Job, error) {
+	if len(random) != RandomSize {
+		return nil, fmt.Errorf("invalid random length: %d", len(random))
+	}
+	return FromData(Data(header, random, seed), prefixes, iterations)
+}
+
+// FromData builds a job from a whole block
+func FromData(data []byte, prefixes int, iterations uint32) (*Job, error) {
+	if len(data) != DataSize {
+		return nil, fmt.Errorf("invalid block length: %d", len(data))
+	}
+	if prefixes <= 0 {
+		return nil, fmt.Errorf("invalid prefix count: %d", prefixes)
+	}
+
+	// Every prefix has expires decremented by its index
+	expires := binary.BigEndian.Uint32(data[expiresOffset:])
+	job := &Job{
+		Iterations: iterations,
+		Expires:    expires,
+		Prefixes:   make([][]byte, prefixes),
+		Midstates:  make([]Digest, prefixes),
+	}
+	for i := range job.Prefixes {
+		prefix := append([]byte(nil), data[:PrefixSize]...)
+		binary.BigEndian.PutUint32(prefix[expiresOffset:], expires-uint32(i))
+		job.Prefixes[i] = prefix
+		job.Midstates[i] = NewDigest()
+		job.Midstates[i].Block(prefix)
+	}
+
+	suffix := append([]byte(nil), data[PrefixSize:]...)
+	job.Random = suffix[randomOffset:]
+	job.Suffix = append(suffix, 0x80, 0x00, 0x00, 0x00, 0x00)
+	return job, nil
+}
+
+// Payload is job as sent to chip: midstates, suffix, iterations and target
+// with the result limit when target is set
+func (job *Job) Payload() []byte {
+	res := make([]byte, 0, len(job.Midstates)*32+len(job.Suffix)+4+len(job.Target)+1)
+	for i := range job.Midstates {
+		res = append(res, job.Midstates[i].Bytes()...)
+	}
+	res = append(res, job.Suffix...)
+	iterations := make([]byte, 4)
+	binary.BigEndian.PutUint32(iterations, job.Iterations)
+	res = append(res, iterations...)
+	if job.Target != nil {
+		res = append(res, job.Target...)
+		res = append(res, job.MaxResults)
+	}
+	return res
+}
+
+// FirstNonce is the nonce chip starts search from
+func (job *Job) FirstNonce() uint32 {
+	return binary.BigEndian.Uint32(job.Suffix)
+}
+
+// Hash calculates hash of a prefix and a nonce
+func (job *Job) Hash(prefix int, nonce uint32) []byte {
+	block := append([]byte(nil), job.Suffix...)
+	binary.BigEndian.PutUint32(block[0:], nonce)
+	binary.BigEndian.PutUint32(block[nonceOffset:], nonce)
+	return Finish(job.Midstates[prefix], block)
+}
+
+// Finish hashes the second block of a message from midstate of the first one
+func Finish(midstate Digest, block []byte) []byte {
+	midstate.Block(block)
+	midstate.Block(tail)
+	return midstate.Bytes()
+}
+
+// Share builds a share of a prefix and a nonce, random is the one of job with
+// the nonce spliced in
+func (job *Job) Share(prefix int, nonce uint32, value []byte) *Share {
+	random := append([]byte(nil), job.Random...)
+	binary.BigEndian.PutUint32(random[nonceOffset-randomOffset:], nonce)
+	return &Share{
+		Random:  random,
+		Value:   value,
+		Expires: job.Expires - uint32(prefix),
+		Prefix:  prefix,
+		Nonce:   nonce,
+	}
+}
+
+// Verify checks a single hash, nonce and prefix index reported by chip against
+// locally calculated hash
+func (job *Job) Verify(response []byte) (*Share, error) {
+	if len(response) < ResultSize {
+		return nil, fmt.Errorf("invalid job response: %x", response)
+	}
+	hash := response[0:32]
+	nonce := binary.BigEndian.Uint32(response[32:])
+	prefix := binary.BigEndian.Uint32(response[36:])
+	if prefix >= uint32(len(job.Prefixes)) {
+		return nil, fmt.Errorf("invalid prefix id %d", prefix)
+	}
+	local := job.Hash(int(prefix), nonce)
+	if !bytes.Equal(hash, local) {
+		return nil, fmt.Errorf("hash mismatch. Expected %x, but got %x", local, hash)
+	}
+	return job.Share(int(prefix), nonce, local), nil
+}
+
+// VerifyAll checks response of a job with target: a count followed by results.
+// Every result is verified and the ones that passed are returned even if
+// others failed.
+func (job *Job) VerifyAll(response []byte) ([]*Share, error) {
+	if job.Target == nil {
+		share, err := job.Verify(response)
+		if err != nil {
+			return nil, err
+		}
+		return []*Share{share}, nil
+	}
+
+	if len(response) == 0 || len(response) != 1+int(response[0])*ResultSize {
+		return nil, fmt.Errorf("invalid job response: %x", response)
+	}
+	res := make([]*Share, 0)
+	var lastErr error
+	for i := 0; i < int(response[0]); i++ {
+		share, err := job.Verify(response[1+i*ResultSize : 1+(i+1)*ResultSize])
+		if err == nil && !IsShare(share.Value, job.Target) {
+			err = fmt.Errorf("hash %x is above target", share.Value)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		res = append(res, share)
+	}
+	return res, lastErr
+}
+
+// IsShare checks if hash is not above target, both are big endian 256 bit
+// numbers
+func IsShare(value []byte, target []byte) bool {
+	return bytes.Compare(value, target) <= 0
+}
@@ -0,0 +1,215 @@
+package work
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	res, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// response builds a single result as chip reports it
+func response(hash []byte, nonce uint32, prefix uint32) []byte {
+	res := make([]byte, ResultSize)
+	copy(res, hash)
+	binary.BigEndian.PutUint32(res[32:], nonce)
+	binary.BigEndian.PutUint32(res[36:], prefix)
+	return res
+}
+
+// readmeJob is the job of README example: an all-zero block
+func readmeJob(t *testing.T, prefixes int) *Job {
+	job, err := FromData(make([]byte, DataSize), prefixes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// readmeOutput is the hash of README example
+const readmeOutput = "409a7f83ac6b31dc8c77e3ec18038f209bd2f545e0f4177c2e2381aa4e067b49"
+
+// Hash of every prefix and nonce is SHA-256 of the whole block with expires
+// and nonce written into it
+func TestJobHash(t *testing.T) {
+	data := make([]byte, DataSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	job, err := FromData(data, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prefix := 0; prefix < 4; prefix++ {
+		for _, nonce := range []uint32{0, 1, job.FirstNonce(), 0xdeadbeef} {
+			share := job.Share(prefix, nonce, job.Hash(prefix, nonce))
+			block := append([]byte(nil), data...)
+			binary.BigEndian.PutUint32(block[expiresOffset:], share.Expires)
+			binary.BigEndian.PutUint32(block[PrefixSize:], nonce)
+			copy(block[PrefixSize+randomOffset:], share.Random)
+			expected := sha256.Sum256(block)
+			if !bytes.Equal(share.Value, expected[:]) {
+				t.Fatalf("prefix %d, nonce %08x: expected %x, got %x", prefix, nonce, expected, share.Value)
+			}
+		}
+	}
+}
+
+// readmePacket reads a hex packet of README example that follows the title
+func readmePacket(t *testing.T, readme string, title string) []byte {
+	at := strings.Index(readme, "\n"+title)
+	if at < 0 {
+		t.Fatalf("no %q in README", title)
+	}
+	block := readme[strings.Index(readme[at:], "```\n")+at+4:]
+	block = block[:strings.Index(block, "```")]
+	return decodeHex(t, strings.ReplaceAll(block, "\n", ""))
+}
+
+// Job of the test block and response recorded from chip in README: input packet
+// is a magic, a job id and the payload, output packet is a magic, a job id,
+// the hash and the output data, which is the suffix with the nonce at its
+// first and 48th bytes
+func TestJobRecorded(t *testing.T) {
+	readme, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := readmePacket(t, string(readme), "Input:")
+	output := readmePacket(t, string(readme), "Output:")
+	block, err := os.ReadFile("../test_0001.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := FromData(decodeHex(t, strings.TrimSpace(string(block))), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := job.Payload(); !bytes.Equal(payload, input[8:]) {
+		t.Fatalf("expected payload %x, got %x", input[8:], payload)
+	}
+
+	hash := output[8:40]
+	data := output[40:]
+	nonce := binary.BigEndian.Uint32(data[0:])
+	if binary.BigEndian.Uint32(data[nonceOffset:]) != nonce {
+		t.Fatalf("nonce is not repeated in output data %x", data)
+	}
+	shares, err := job.VerifyAll(response(hash, nonce, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || !bytes.Equal(shares[0].Value, hash) || !bytes.Equal(shares[0].Random, data[randomOffset:randomOffset+RandomSize]) {
+		t.Fatalf("unexpected shares: %+v", shares)
+	}
+}
+
+// Share random is the random of output data chip reports for a nonce, expires
+// of a prefix is decremented by its index
+func TestJobShare(t *testing.T) {
+	data := make([]byte, DataSize)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+	job, err := FromData(data, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := uint32(0x01020304)
+	output := append([]byte(nil), job.Suffix...)
+	binary.BigEndian.PutUint32(output[0:], nonce)
+	binary.BigEndian.PutUint32(output[nonceOffset:], nonce)
+	share, err := job.Verify(response(job.Hash(2, nonce), nonce, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(share.Random, output[randomOffset:randomOffset+RandomSize]) {
+		t.Fatalf("expected random %x, got %x", output[randomOffset:randomOffset+RandomSize], share.Random)
+	}
+	if expires := binary.BigEndian.Uint32(data[expiresOffset:]) - 2; share.Expires != expires {
+		t.Fatalf("expected expires %d, got %d", expires, share.Expires)
+	}
+}
+
+func TestJobVerify(t *testing.T) {
+	job := readmeJob(t, 2)
+	output := decodeHex(t, readmeOutput)
+
+	// Second prefix has decremented expires
+	share, err := job.Verify(response(job.Hash(1, 5), 5, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if share.Expires != 0xFFFFFFFF || share.Prefix != 1 || share.Nonce != 5 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+
+	bad := append([]byte(nil), output...)
+	bad[0] ^= 0x01
+	tests := []struct {
+		name     string
+		response []byte
+		err      string
+	}{
+		{"short response", output, "invalid job response"},
+		{"invalid prefix", response(output, 0, 2), "invalid prefix id 2"},
+		{"wrong nonce", response(output, 1, 0), "hash mismatch"},
+		{"wrong hash", response(bad, 0, 0), "hash mismatch"},
+	}
+	for _, test := range tests {
+		if _, err := job.Verify(test.response); err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestJobVerifyAll(t *testing.T) {
+	job := readmeJob(t, 1)
+	job.Target = decodeHex(t, readmeOutput)
+	job.MaxResults = 4
+
+	// Hash equal to target is a share, results above target are dropped and
+	// reported while others are kept
+	results := [][]byte{response(job.Target, 0, 0)}
+	for nonce := uint32(1); len(results) < 3; nonce++ {
+		hash := job.Hash(0, nonce)
+		if !IsShare(hash, job.Target) {
+			results = append(results, response(hash, nonce, 0))
+		}
+	}
+	res := append([]byte{byte(len(results))}, bytes.Join(results, nil)...)
+	shares, err := job.VerifyAll(res)
+	if err == nil || !strings.HasSuffix(err.Error(), "is above target") {
+		t.Fatalf("expected hash above target, got %v", err)
+	}
+	if len(shares) != 1 || shares[0].Nonce != 0 {
+		t.Fatalf("unexpected shares: %+v", shares)
+	}
+
+	for _, invalid := range [][]byte{nil, {1}, res[:len(res)-1]} {
+		if _, err := job.VerifyAll(invalid); err == nil {
+			t.Errorf("invalid response %x is accepted", invalid)
+		}
+	}
+}
+
+func TestIsShare(t *testing.T) {
+	target := decodeHex(t, readmeOutput)
+	above := append([]byte(nil), target...)
+	above[31]++
+	below := append([]byte(nil), target...)
+	below[0]--
+	if !IsShare(target, target) || !IsShare(below, target) || IsShare(above, target) {
+		t.Fatal("hash is compared with target as a big endian number")
+	}
+}
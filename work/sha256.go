@@ -1,6 +1,9 @@
-package main
+package work
 
-import "math/bits"
+import (
+	"encoding/binary"
+	"math/bits"
+)
 
 const (
 	chunk     = 64
@@ -22,10 +25,37 @@ const (
 	init7_224 = 0xBEFA4FA4
 )
 
-type digest struct {
+// Digest is SHA-256 state, a midstate once some whole blocks are hashed
+type Digest struct {
 	h [8]uint32
 }
 
+func NewDigest() Digest {
+	return Digest{h: [8]uint32{init0, init1, init2, init3, init4, init5, init6, init7}}
+}
+
+// ParseDigest reads big endian state, as sent to chips
+func ParseDigest(data []byte) Digest {
+	d := Digest{}
+	for i := range d.h {
+		d.h[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+	return d
+}
+
+// Block hashes whole 64 byte blocks of p
+func (d *Digest) Block(p []byte) {
+	blockGeneric(d, p)
+}
+
+func (d *Digest) Bytes() []byte {
+	res := make([]byte, 32)
+	for i, v := range d.h {
+		binary.BigEndian.PutUint32(res[i*4:], v)
+	}
+	return res
+}
+
 var _K = []uint32{
 	0x428a2f98,
 	0x71374491,
@@ -93,7 +123,7 @@ var _K = []uint32{
 	0xc67178f2,
 }
 
-func blockGeneric(dig *digest, p []byte) {
+func blockGeneric(dig *Digest, p []byte) {
 	var w [64]uint32
 	h0, h1, h2, h3, h4, h5, h6, h7 := dig.h[0], dig.h[1], dig.h[2], dig.h[3], dig.h[4], dig.h[5], dig.h[6], dig.h[7]
 	for len(p) >= chunk {
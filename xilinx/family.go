@@ -1,6 +1,15 @@
-package main
+package xilinx
 
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PllConst is a DRP register, bits set in Mask are kept on write
 type PllConst struct {
+	Name string
 	Addr uint8
 	Mask uint16
 }
@@ -11,29 +20,242 @@ type PllConstValue struct {
 	Value uint16
 }
 
-type XilinxProperty struct {
-	PLLPowerAddr uint8
-	PLLFreq      map[int][]PllConstValue
+// Family describes a chip family: its MMCM register map and limits,
+// and conversion of sysmon values. Frequencies are in MHz, PLLFreq is a table
+// of known good setups, other frequencies are calculated. Mmcm is nil when
+// register map of the family is not known, PLL of such chips is never written.
+type Family struct {
+	Name           string
+	Parts          *regexp.Regexp
+	PLLPowerAddr   uint8
+	PLLFreq        map[int][]PllConstValue
+	Mmcm           *MmcmRegisters
+	InputFrequency float64
+	VcoMin         float64
+	VcoMax         float64
+	PfdMin         float64
+	PfdMax         float64
+	MaxFrequency   int
+
+	// FractionalFeedback is set when fractional CLKFBOUT layout of the family
+	// is known, only integer multipliers are used otherwise
+	FractionalFeedback bool
+
+	// Sysmon codes are MSB justified SysmonBits wide values, temperature is
+	// code * TempScale / 2^16 - TempOffset and supplies are code * VoltageScale / 2^16
+	SysmonBits         uint
+	SysmonTempScale    float32
+	SysmonTempOffset   float32
+	SysmonVoltageScale float32
+}
+
+// MmcmRegisters is a DRP register map of MMCM used for output clock with
+// loop filter and lock detector settings for every integer multiplier
+type MmcmRegisters struct {
+	DivClk    PllConst
+	ClkReg1   PllConst
+	ClkReg2   PllConst
+	ClkFbOut1 PllConst
+	ClkFbOut2 PllConst
+	FiltReg1  PllConst
+	FiltReg2  PllConst
+	Lock1     PllConst
+	Lock2     PllConst
+	Lock3     PllConst
+
+	FilterTable *[64]uint16
+	LockTable   *[64]uint64
+}
+
+// All returns registers in the same order as the frequency table
+func (regs *MmcmRegisters) All() []PllConst {
+	return []PllConst{regs.DivClk, regs.ClkReg1, regs.ClkReg2, regs.ClkFbOut1, regs.ClkFbOut2,
+		regs.FiltReg1, regs.FiltReg2, regs.Lock1, regs.Lock2, regs.Lock3}
+}
+
+func (prop *Family) String() string {
+	return prop.Name
+}
+
+// Registers returns MMCM register map of the family
+func (prop *Family) Registers() (*MmcmRegisters, error) {
+	if prop.Mmcm == nil {
+		return nil, fmt.Errorf("MMCM register map of %v is not known", prop)
+	}
+	return prop.Mmcm, nil
+}
+
+// ReadRegisters returns MMCM registers of the family, families without register
+// map get raw DRP addresses of clock outputs, divider, feedback, lock and loop
+// filter that are common to MMCM generations (XAPP888)
+func (prop *Family) ReadRegisters() []PllConst {
+	if prop.Mmcm != nil {
+		return prop.Mmcm.All()
+	}
+	res := make([]PllConst, 0)
+	for addr := uint8(0x06); addr <= 0x1A; addr++ {
+		res = append(res, PllConst{Name: fmt.Sprintf("drp-%02x", addr), Addr: addr})
+	}
+	return append(res, PllConst{Name: "drp-4e", Addr: 0x4E}, PllConst{Name: "drp-4f", Addr: 0x4F})
+}
+
+// Setup returns PLL register values for a frequency
+func (prop *Family) Setup(frequency int) ([]PllConstValue, error) {
+	if _, err := prop.Registers(); err != nil {
+		return nil, err
+	}
+	if setup, found := prop.PLLFreq[frequency]; found {
+		return setup, nil
+	}
+	config, err := CalculateMmcm(prop, float64(frequency))
+	if err != nil {
+		return nil, err
+	}
+	return config.Registers(prop)
+}
+
+// Frequencies returns frequencies of PLL table in ascending order, families
+// without a table get reachable frequencies in 10 MHz steps. Families without
+// register map have none.
+func (prop *Family) Frequencies() []int {
+	res := make([]int, 0, len(prop.PLLFreq))
+	if prop.Mmcm == nil {
+		return res
+	}
+	if len(prop.PLLFreq) == 0 {
+		for frequency := 10; frequency <= prop.MaxFrequency; frequency += 10 {
+			if _, err := CalculateMmcm(prop, float64(frequency)); err == nil {
+				res = append(res, frequency)
+			}
+		}
+		return res
+	}
+	for frequency := range prop.PLLFreq {
+		res = append(res, frequency)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// SysmonValue converts raw sysmon register into degrees Celsius or volts
+func (prop *Family) SysmonValue(sensor *Sensor, raw uint16) float32 {
+	code := float32(raw &^ (1<<(16-prop.SysmonBits) - 1))
+	if sensor.Kind == SensorTemperature {
+		return code*prop.SysmonTempScale/65536 - prop.SysmonTempOffset
+	}
+	return code * prop.SysmonVoltageScale / 65536
+}
+
+// SysmonRaw is a sysmon register value for degrees Celsius or volts
+func (prop *Family) SysmonRaw(sensor *Sensor, value float32) uint16 {
+	var code float32
+	if sensor.Kind == SensorTemperature {
+		code = (value + prop.SysmonTempOffset) * 65536 / prop.SysmonTempScale
+	} else {
+		code = value * 65536 / prop.SysmonVoltageScale
+	}
+	step := float32(uint16(1) << (16 - prop.SysmonBits))
+	code = float32(int(code/step+0.5)) * step
+	if code < 0 {
+		return 0
+	}
+	if code > 65536-step {
+		return uint16(65536 - step)
+	}
+	return uint16(code)
 }
 
 var (
-	DivClk   = PllConst{0x16, 0xC000}
-	ClkReg1  = PllConst{0x0A, 0x1000}
-	ClkReg2  = PllConst{0x0B, 0xFC00}
-	ClkFbOut = PllConst{0x14, 0x1000}
-	FiltReg1 = PllConst{0x4E, 0x66FF}
-	FiltReg2 = PllConst{0x4F, 0x666F}
-	Lock1    = PllConst{0x18, 0xFC00}
-	Lock2    = PllConst{0x19, 0x8000}
-	Lock3    = PllConst{0x1A, 0x8000}
-
-	ClkFbOut1 = PllConst{0x14, 0x1000}
-	ClkFbOut2 = PllConst{0x15, 0x8000}
+	DivClk   = PllConst{Name: "divclk", Addr: 0x16, Mask: 0xC000}
+	ClkReg1  = PllConst{Name: "clkout1-1", Addr: 0x0A, Mask: 0x1000}
+	ClkReg2  = PllConst{Name: "clkout1-2", Addr: 0x0B, Mask: 0xFC00}
+	ClkFbOut = PllConst{Name: "clkfbout", Addr: 0x14, Mask: 0x1000}
+	FiltReg1 = PllConst{Name: "filter-1", Addr: 0x4E, Mask: 0x66FF}
+	FiltReg2 = PllConst{Name: "filter-2", Addr: 0x4F, Mask: 0x666F}
+	Lock1    = PllConst{Name: "lock-1", Addr: 0x18, Mask: 0xFC00}
+	Lock2    = PllConst{Name: "lock-2", Addr: 0x19, Mask: 0x8000}
+	Lock3    = PllConst{Name: "lock-3", Addr: 0x1A, Mask: 0x8000}
+
+	ClkFbOut1 = PllConst{Name: "clkfbout-1", Addr: 0x14, Mask: 0x1000}
+	ClkFbOut2 = PllConst{Name: "clkfbout-2", Addr: 0x15, Mask: 0x8000}
+
+	// MMCME2 layout with filter and lock tables of XAPP888 reference design
+	MmcmRegisters7Series = MmcmRegisters{
+		DivClk:    DivClk,
+		ClkReg1:   ClkReg1,
+		ClkReg2:   ClkReg2,
+		ClkFbOut1: ClkFbOut1,
+		ClkFbOut2: ClkFbOut2,
+		FiltReg1:  FiltReg1,
+		FiltReg2:  FiltReg2,
+		Lock1:     Lock1,
+		Lock2:     Lock2,
+		Lock3:     Lock3,
+
+		FilterTable: &mmcmFilterLow,
+		LockTable:   &mmcmLock,
+	}
 )
 
+//
+// Families
+//
+
+// Families are matched against part name in order
+var Families = []*Family{&Series7, &UltraScalePlus, &UltraScale}
+
+// FindFamily selects family by part name as found in bitstream header, e.g.
+// 7k355tffg901 or xcku040-ffva1156-2-e
+func FindFamily(part string) (*Family, error) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(part)), "xc")
+	for _, family := range Families {
+		if family.Parts.MatchString(name) {
+			return family, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown part %s", part)
+}
+
+// FindFamilyByName selects family by its name or part name. Families without
+// register map are refused: they are only detected by bitstream part, so that
+// their PLL is not written with the map of 7-series.
+func FindFamilyByName(name string) (*Family, error) {
+	var res *Family
+	for _, family := range Families {
+		if strings.EqualFold(family.Name, name) {
+			res = family
+		}
+	}
+	if res == nil {
+		family, err := FindFamily(name)
+		if err != nil {
+			return nil, err
+		}
+		res = family
+	}
+	if _, err := res.Registers(); err != nil {
+		return nil, fmt.Errorf("%v is not supported: %v", res, err)
+	}
+	return res, nil
+}
+
 var (
-	Xilinx7Series = XilinxProperty{
-		PLLPowerAddr: 0x28,
+	Series7 = Family{
+		Name:               "7series",
+		Parts:              regexp.MustCompile(`^7[aksvz]`),
+		PLLPowerAddr:       0x28,
+		Mmcm:               &MmcmRegisters7Series,
+		InputFrequency:     100,
+		VcoMin:             600,
+		VcoMax:             1200,
+		PfdMin:             10,
+		PfdMax:             450,
+		MaxFrequency:       800,
+		FractionalFeedback: true,
+		SysmonBits:         12,
+		SysmonTempScale:    503.975,
+		SysmonTempOffset:   273.15,
+		SysmonVoltageScale: 3,
 		PLLFreq: map[int][]PllConstValue{
 			50:  []PllConstValue{{DivClk, 0x2083}, {ClkReg1, 0x0186}, {ClkReg2, 0x0000}, {ClkFbOut1, 0x03cf}, {ClkFbOut2, 0x0000}, {FiltReg1, 0x0800}, {FiltReg2, 0x8800}, {Lock1, 0x0145}, {Lock2, 0x7c01}, {Lock3, 0x7fe9}},
 			60:  []PllConstValue{{DivClk, 0x2083}, {ClkReg1, 0x0186}, {ClkReg2, 0x0000}, {ClkFbOut1, 0x0492}, {ClkFbOut2, 0x0000}, {FiltReg1, 0x0800}, {FiltReg2, 0x9000}, {Lock1, 0x0113}, {Lock2, 0x7c01}, {Lock3, 0x7fe9}},
@@ -114,3 +336,47 @@ var (
 		},
 	}
 )
+
+//
+// MMCME3 and MMCME4 of UltraScale families have own DRP layout, filter and lock
+// tables (UG572, XAPP888 mmcme3_drp and mmcme4_drp) that are not verified on
+// hardware yet. These families have no register map until then: they can't
+// be selected by name, chips detected by bitstream part are monitored, their
+// PLL is only read and never written.
+//
+
+var (
+	UltraScale = Family{
+		Name:               "ultrascale",
+		Parts:              regexp.MustCompile(`^(ku|vu)\d+`),
+		PLLPowerAddr:       0x27,
+		InputFrequency:     100,
+		VcoMin:             600,
+		VcoMax:             1440,
+		PfdMin:             10,
+		PfdMax:             500,
+		MaxFrequency:       850,
+		FractionalFeedback: false,
+		SysmonBits:         10,
+		SysmonTempScale:    502.9098,
+		SysmonTempOffset:   273.8195,
+		SysmonVoltageScale: 3,
+	}
+
+	UltraScalePlus = Family{
+		Name:               "ultrascale+",
+		Parts:              regexp.MustCompile(`^((ku|vu)\d+p|zu\d+)`),
+		PLLPowerAddr:       0x27,
+		InputFrequency:     100,
+		VcoMin:             800,
+		VcoMax:             1600,
+		PfdMin:             10,
+		PfdMax:             500,
+		MaxFrequency:       890,
+		FractionalFeedback: false,
+		SysmonBits:         10,
+		SysmonTempScale:    509.3140064,
+		SysmonTempOffset:   280.2308787,
+		SysmonVoltageScale: 3,
+	}
+)
@@ -0,0 +1,319 @@
+package xilinx
+
+import (
+	"fmt"
+	"math"
+)
+
+//
+// MMCM calculator derives DRP register values of an MMCM for arbitrary output
+// frequency, following XAPP888. Register map and limits come from the chip
+// family. Output clock is CLKOUT1:
+//
+//	Fout = Fin * CLKFBOUT_MULT / DIVCLK_DIVIDE / CLKOUT1_DIVIDE
+//
+// CLKFBOUT_MULT could be fractional in 1/8 steps if family supports it, both
+// dividers are integer.
+//
+
+// MmcmConfig is a set of MMCM counters, Multiply is in 1/8 steps
+type MmcmConfig struct {
+	Divide    int
+	Multiply  int
+	OutDivide int
+}
+
+const (
+	MmcmMultiplyMin  = 2 * 8
+	MmcmMultiplyMax  = 64 * 8
+	MmcmDivideMax    = 106
+	MmcmOutDivideMax = 128
+)
+
+// MmcmFrequencyTolerance is how far from requested frequency the result could be, in MHz
+const MmcmFrequencyTolerance = 0.001
+
+func (config *MmcmConfig) Vco(input float64) float64 {
+	return input * float64(config.Multiply) / 8 / float64(config.Divide)
+}
+
+func (config *MmcmConfig) Frequency(input float64) float64 {
+	return config.Vco(input) / float64(config.OutDivide)
+}
+
+func (config *MmcmConfig) Fractional() bool {
+	return config.Multiply%8 != 0
+}
+
+func (config *MmcmConfig) String() string {
+	return fmt.Sprintf("divclk=%d clkfbout=%.3f clkout1=%d", config.Divide, float64(config.Multiply)/8, config.OutDivide)
+}
+
+// CalculateMmcm finds counters for requested frequency in MHz. Highest VCO
+// frequency is preferred since it gives the lowest jitter, then integer
+// multiplier and then the lowest divider.
+func CalculateMmcm(prop *Family, frequency float64) (*MmcmConfig, error) {
+	var best *MmcmConfig
+	for divide := 1; divide <= MmcmDivideMax; divide++ {
+		pfd := prop.InputFrequency / float64(divide)
+		if pfd < prop.PfdMin || pfd > prop.PfdMax {
+			continue
+		}
+		for outDivide := 1; outDivide <= MmcmOutDivideMax; outDivide++ {
+			vco := frequency * float64(outDivide)
+			if vco < prop.VcoMin || vco > prop.VcoMax {
+				continue
+			}
+			multiply := int(math.Round(vco / pfd * 8))
+			if multiply < MmcmMultiplyMin || multiply > MmcmMultiplyMax {
+				continue
+			}
+			if multiply%8 != 0 && !prop.FractionalFeedback {
+				continue
+			}
+			config := &MmcmConfig{Divide: divide, Multiply: multiply, OutDivide: outDivide}
+			if math.Abs(config.Frequency(prop.InputFrequency)-frequency) > MmcmFrequencyTolerance {
+				continue
+			}
+			if best == nil || betterMmcm(config, best, prop.InputFrequency) {
+				best = config
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("frequency %v MHz is not reachable", frequency)
+	}
+	return best, nil
+}
+
+func betterMmcm(a *MmcmConfig, b *MmcmConfig, input float64) bool {
+	if a.Vco(input) != b.Vco(input) {
+		return a.Vco(input) > b.Vco(input)
+	}
+	if a.Fractional() != b.Fractional() {
+		return !a.Fractional()
+	}
+	return a.Divide < b.Divide
+}
+
+// Registers returns DRP values in the same layout as the frequency table
+func (config *MmcmConfig) Registers(prop *Family) ([]PllConstValue, error) {
+	regs, err := prop.Registers()
+	if err != nil {
+		return nil, err
+	}
+	high, low, edge, noCount := mmcmCount(config.Divide)
+	divClk := edge<<13 | noCount<<12 | high<<6 | low
+
+	high, low, edge, noCount = mmcmCount(config.OutDivide)
+	clkReg1 := high<<6 | low
+	clkReg2 := edge<<7 | noCount<<6
+
+	var fbOut1, fbOut2 uint16
+	if config.Fractional() {
+		fbOut1, fbOut2 = mmcmFracCount(config.Multiply)
+	} else {
+		high, low, edge, noCount = mmcmCount(config.Multiply / 8)
+		fbOut1 = high<<6 | low
+		fbOut2 = edge<<7 | noCount<<6
+	}
+
+	filter := regs.FilterTable[config.Multiply/8-1]
+	filt1 := (filter>>9&1)<<15 | (filter>>7&3)<<11 | (filter>>6&1)<<8
+	filt2 := (filter>>5&1)<<15 | (filter>>3&3)<<11 | (filter>>1&3)<<7 | (filter&1)<<4
+
+	lock := regs.LockTable[config.Multiply/8-1]
+	lock1 := uint16(lock >> 20 & 0x3ff)
+	lock2 := uint16(lock>>30&0x1f)<<10 | uint16(lock&0x3ff)
+	lock3 := uint16(lock>>35&0x1f)<<10 | uint16(lock>>10&0x3ff)
+
+	return []PllConstValue{
+		{regs.DivClk, divClk},
+		{regs.ClkReg1, clkReg1},
+		{regs.ClkReg2, clkReg2},
+		{regs.ClkFbOut1, fbOut1},
+		{regs.ClkFbOut2, fbOut2},
+		{regs.FiltReg1, filt1},
+		{regs.FiltReg2, filt2},
+		{regs.Lock1, lock1},
+		{regs.Lock2, lock2},
+		{regs.Lock3, lock3},
+	}, nil
+}
+
+// DecodeMmcm reads counters back from DRP values, values missing from the
+// map are not known
+func DecodeMmcm(prop *Family, values map[uint8]uint16) (*MmcmConfig, error) {
+	regs, err := prop.Registers()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []PllConst{regs.DivClk, regs.ClkReg1, regs.ClkReg2, regs.ClkFbOut1, regs.ClkFbOut2} {
+		if _, found := values[c.Addr]; !found {
+			return nil, fmt.Errorf("register %02x is not known", c.Addr)
+		}
+	}
+	decode := func(value uint16, noCount uint16) int {
+		if noCount != 0 {
+			return 1
+		}
+		return int(value>>6&0x3f + value&0x3f)
+	}
+	divClk := values[regs.DivClk.Addr]
+	clkReg1 := values[regs.ClkReg1.Addr]
+	clkReg2 := values[regs.ClkReg2.Addr]
+	fbOut1 := values[regs.ClkFbOut1.Addr]
+	fbOut2 := values[regs.ClkFbOut2.Addr]
+	config := &MmcmConfig{
+		Divide:    decode(divClk, divClk>>12&1),
+		OutDivide: decode(clkReg1, clkReg2>>6&1),
+	}
+	if config.Divide == 0 || config.OutDivide == 0 {
+		return nil, fmt.Errorf("invalid counters %04x %04x", divClk, clkReg1)
+	}
+
+	// Fractional counter has both halves shortened
+	if fbOut2>>11&1 != 0 {
+		frac := int(fbOut2 >> 12 & 7)
+		high := int(fbOut1 >> 6 & 0x3f)
+		low := int(fbOut1 & 0x3f)
+		for multiply := 2; multiply <= 64; multiply++ {
+			h, l := mmcmFracCount(multiply*8 + frac)
+			if int(h>>6&0x3f) == high && int(h&0x3f) == low && l == fbOut2&0x7c00 {
+				config.Multiply = multiply*8 + frac
+				return config, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid fractional counter %04x %04x", fbOut1, fbOut2)
+	}
+	config.Multiply = decode(fbOut1, fbOut2>>6&1) * 8
+	if config.Multiply == 0 {
+		return nil, fmt.Errorf("invalid feedback counter %04x", fbOut1)
+	}
+	return config, nil
+}
+
+// mmcmCount splits divider into high and low times with 50% duty cycle
+func mmcmCount(divide int) (high uint16, low uint16, edge uint16, noCount uint16) {
+	if divide == 1 {
+		return 1, 1, 0, 1
+	}
+	high = uint16(divide / 2)
+	low = uint16(divide) - high
+	edge = uint16(divide % 2)
+	return high, low, edge, 0
+}
+
+// mmcmFracCount is a fractional CLKFBOUT counter with zero phase, multiply is
+// in 1/8 steps. Falling edge bits live in CLKOUT6 registers and are not
+// touched, same as in the frequency table.
+func mmcmFracCount(multiply int) (uint16, uint16) {
+	divide := multiply / 8
+	frac := multiply % 8
+	even := divide / 2
+	odd := divide - 2*even
+	oddAndFrac := 8*odd + frac
+	lt := even
+	if oddAndFrac <= 9 {
+		lt--
+	}
+	ht := even
+	if oddAndFrac <= 8 {
+		ht--
+	}
+	var wfRise uint16
+	if oddAndFrac >= 1 && oddAndFrac <= 8 {
+		wfRise = 1
+	}
+	return uint16(ht)<<6 | uint16(lt), uint16(frac)<<12 | 1<<11 | wfRise<<10
+}
+
+// mmcmFilterLow is a MMCME2 loop filter setting for every integer multiplier,
+// low bandwidth: CP[3:0], RES[3:0], LFHF[1:0]
+var mmcmFilterLow = [64]uint16{
+	0b0010_1111_00, 0b0010_1111_00, 0b0010_1111_00, 0b0010_1111_00,
+	0b0010_0111_00, 0b0010_1011_00, 0b0010_1101_00, 0b0010_0011_00,
+	0b0010_0101_00, 0b0010_0101_00, 0b0010_1001_00, 0b0010_1110_00,
+	0b0010_1110_00, 0b0010_1110_00, 0b0010_1110_00, 0b0010_0001_00,
+	0b0010_0001_00, 0b0010_0001_00, 0b0010_0110_00, 0b0010_0110_00,
+	0b0010_0110_00, 0b0010_0110_00, 0b0010_0110_00, 0b0010_0110_00,
+	0b0010_0110_00, 0b0010_1010_00, 0b0010_1010_00, 0b0010_1010_00,
+	0b0010_1010_00, 0b0010_1010_00, 0b0010_1100_00, 0b0010_1100_00,
+	0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00,
+	0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00,
+	0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00,
+	0b0010_1100_00, 0b0010_1100_00, 0b0010_1100_00, 0b0010_0010_00,
+	0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00,
+	0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00,
+	0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00,
+	0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00, 0b0010_0010_00,
+}
+
+// mmcmLock is a MMCME2 lock detector setting for every integer multiplier:
+// LockRefDly[4:0], LockFBDly[4:0], LockCnt[9:0], LockSatHigh[9:0], UnlockCnt[9:0]
+var mmcmLock = [64]uint64{
+	0b00110_00110_1111101000_1111101001_0000000001,
+	0b00110_00110_1111101000_1111101001_0000000001,
+	0b01000_01000_1111101000_1111101001_0000000001,
+	0b01011_01011_1111101000_1111101001_0000000001,
+	0b01110_01110_1111101000_1111101001_0000000001,
+	0b10001_10001_1111101000_1111101001_0000000001,
+	0b10011_10011_1111101000_1111101001_0000000001,
+	0b10110_10110_1111101000_1111101001_0000000001,
+	0b11001_11001_1111101000_1111101001_0000000001,
+	0b11100_11100_1111101000_1111101001_0000000001,
+	0b11111_11111_1110000100_1111101001_0000000001,
+	0b11111_11111_1100111001_1111101001_0000000001,
+	0b11111_11111_1011101110_1111101001_0000000001,
+	0b11111_11111_1010111100_1111101001_0000000001,
+	0b11111_11111_1010001010_1111101001_0000000001,
+	0b11111_11111_1001110001_1111101001_0000000001,
+	0b11111_11111_1000111111_1111101001_0000000001,
+	0b11111_11111_1000100110_1111101001_0000000001,
+	0b11111_11111_1000001101_1111101001_0000000001,
+	0b11111_11111_0111110100_1111101001_0000000001,
+	0b11111_11111_0111011011_1111101001_0000000001,
+	0b11111_11111_0111000010_1111101001_0000000001,
+	0b11111_11111_0110101001_1111101001_0000000001,
+	0b11111_11111_0110010000_1111101001_0000000001,
+	0b11111_11111_0110010000_1111101001_0000000001,
+	0b11111_11111_0101110111_1111101001_0000000001,
+	0b11111_11111_0101011110_1111101001_0000000001,
+	0b11111_11111_0101011110_1111101001_0000000001,
+	0b11111_11111_0101000101_1111101001_0000000001,
+	0b11111_11111_0101000101_1111101001_0000000001,
+	0b11111_11111_0100101100_1111101001_0000000001,
+	0b11111_11111_0100101100_1111101001_0000000001,
+	0b11111_11111_0100101100_1111101001_0000000001,
+	0b11111_11111_0100010011_1111101001_0000000001,
+	0b11111_11111_0100010011_1111101001_0000000001,
+	0b11111_11111_0100010011_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+	0b11111_11111_0011111010_1111101001_0000000001,
+}
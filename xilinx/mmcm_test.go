@@ -0,0 +1,103 @@
+package xilinx
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func values(setup []PllConstValue) map[uint8]uint16 {
+	res := make(map[uint8]uint16)
+	for _, cv := range setup {
+		res[cv.Const.Addr] = cv.Value
+	}
+	return res
+}
+
+// Every entry of the frequency table decodes to its frequency and is encoded
+// back to the same values
+func TestMmcmTable(t *testing.T) {
+	prop := &Series7
+	for _, frequency := range prop.Frequencies() {
+		setup := prop.PLLFreq[frequency]
+		config, err := DecodeMmcm(prop, values(setup))
+		if err != nil {
+			t.Errorf("%d MHz: %v", frequency, err)
+			continue
+		}
+		if math.Abs(config.Frequency(prop.InputFrequency)-float64(frequency)) > MmcmFrequencyTolerance {
+			t.Errorf("%d MHz: decoded %v runs at %v MHz", frequency, config, config.Frequency(prop.InputFrequency))
+		}
+		registers, err := config.Registers(prop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(registers, setup) {
+			t.Errorf("%d MHz: %v encoded as %04x, expected %04x", frequency, config, registers, setup)
+		}
+		decoded, err := DecodeMmcm(prop, values(registers))
+		if err != nil || *decoded != *config {
+			t.Errorf("%d MHz: %v decoded back as %v (%v)", frequency, config, decoded, err)
+		}
+	}
+}
+
+// Calculated setups of every reachable frequency round trip through registers
+func TestCalculateMmcm(t *testing.T) {
+	for _, prop := range []*Family{&Series7} {
+		for frequency := 10; frequency <= prop.MaxFrequency; frequency += 5 {
+			config, err := CalculateMmcm(prop, float64(frequency))
+			if err != nil {
+				continue
+			}
+			vco := config.Vco(prop.InputFrequency)
+			pfd := prop.InputFrequency / float64(config.Divide)
+			if vco < prop.VcoMin || vco > prop.VcoMax || pfd < prop.PfdMin || pfd > prop.PfdMax {
+				t.Errorf("%s %d MHz: %v is out of limits", prop, frequency, config)
+			}
+			registers, err := config.Registers(prop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodeMmcm(prop, values(registers))
+			if err != nil || *decoded != *config {
+				t.Errorf("%s %d MHz: %v decoded back as %v (%v)", prop, frequency, config, decoded, err)
+			}
+		}
+	}
+}
+
+func TestCalculateMmcmUnreachable(t *testing.T) {
+	if _, err := CalculateMmcm(&Series7, 1); err == nil {
+		t.Fatal("1 MHz is below VCO range of every divider")
+	}
+}
+
+// PLL of families without a known register map is never written
+func TestUnknownRegisterMap(t *testing.T) {
+	for _, prop := range []*Family{&UltraScale, &UltraScalePlus} {
+		if _, err := prop.Setup(100); err == nil {
+			t.Errorf("%s: setup without register map", prop)
+		}
+		if frequencies := prop.Frequencies(); len(frequencies) != 0 {
+			t.Errorf("%s: frequencies without register map: %v", prop, frequencies)
+		}
+		if _, err := DecodeMmcm(prop, values(Series7.PLLFreq[100])); err == nil {
+			t.Errorf("%s: decoded without register map", prop)
+		}
+		if _, err := FindFamilyByName(prop.Name); err == nil {
+			t.Errorf("%s: selected by name without register map", prop)
+		}
+	}
+
+	// Chips are still detected by bitstream part, so they are not taken for
+	// 7-series
+	for part, expected := range map[string]*Family{"xcku040-ffva1156-2-e": &UltraScale, "xczu9eg-ffvb1156-2-e": &UltraScalePlus, "7k355tffg901": &Series7} {
+		if family, err := FindFamily(part); err != nil || family != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", part, expected, family, err)
+		}
+	}
+	if _, err := FindFamilyByName("xcku040-ffva1156-2-e"); err == nil {
+		t.Error("part without register map is selected")
+	}
+}
@@ -0,0 +1,103 @@
+package xilinx
+
+import "strings"
+
+//
+// XADC and UltraScale SYSMON share register addresses of sensors, their
+// min/max trackers, alarm thresholds and flags. Conversion of register
+// values depends on family.
+//
+
+// XADC registers
+const (
+	SysmonFlags   = 0x3F
+	SysmonOTLimit = 0x53
+	SysmonOTReset = 0x57
+)
+
+type SensorKind int
+
+const (
+	SensorTemperature SensorKind = iota
+	SensorVoltage
+)
+
+// Sensor is an XADC channel with its min/max trackers and alarm thresholds
+type Sensor struct {
+	Name  string
+	Kind  SensorKind
+	Addr  uint8
+	Max   uint8
+	Min   uint8
+	Upper uint8
+	Lower uint8
+
+	// Alarm is the bit of flag register raised when value is out of thresholds
+	Alarm SysmonFlag
+}
+
+var (
+	SensorTemp    = Sensor{Name: "temperature", Kind: SensorTemperature, Addr: 0x00, Max: 0x20, Min: 0x24, Upper: 0x50, Lower: 0x54, Alarm: SysmonAlarmTemp}
+	SensorVccInt  = Sensor{Name: "vccint", Kind: SensorVoltage, Addr: 0x01, Max: 0x21, Min: 0x25, Upper: 0x51, Lower: 0x55, Alarm: SysmonAlarmVccInt}
+	SensorVccAux  = Sensor{Name: "vccaux", Kind: SensorVoltage, Addr: 0x02, Max: 0x22, Min: 0x26, Upper: 0x52, Lower: 0x56, Alarm: SysmonAlarmVccAux}
+	SensorVccBram = Sensor{Name: "vccbram", Kind: SensorVoltage, Addr: 0x06, Max: 0x23, Min: 0x27, Upper: 0x58, Lower: 0x5C, Alarm: SysmonAlarmVccBram}
+	Sensors       = []*Sensor{&SensorTemp, &SensorVccInt, &SensorVccAux, &SensorVccBram}
+)
+
+// FindSensor looks a sensor up by name
+func FindSensor(name string) *Sensor {
+	for _, sensor := range Sensors {
+		if sensor.Name == name {
+			return sensor
+		}
+	}
+	return nil
+}
+
+func (sensor *Sensor) Unit() string {
+	if sensor.Kind == SensorTemperature {
+		return "C"
+	}
+	return "V"
+}
+
+// SysmonFlag is a bit of XADC flag register
+type SysmonFlag uint16
+
+const (
+	SysmonAlarmTemp    SysmonFlag = 1 << 0
+	SysmonAlarmVccInt  SysmonFlag = 1 << 1
+	SysmonAlarmVccAux  SysmonFlag = 1 << 2
+	SysmonOverTemp     SysmonFlag = 1 << 3
+	SysmonAlarmVccBram SysmonFlag = 1 << 4
+)
+
+var sysmonFlagNames = []struct {
+	flag SysmonFlag
+	name string
+}{
+	{SysmonAlarmTemp, "temperature"},
+	{SysmonAlarmVccInt, "vccint"},
+	{SysmonAlarmVccAux, "vccaux"},
+	{SysmonOverTemp, "overtemperature"},
+	{SysmonAlarmVccBram, "vccbram"},
+}
+
+// Alarms lists names of raised alarms
+func (flags SysmonFlag) Alarms() []string {
+	res := make([]string, 0)
+	for _, f := range sysmonFlagNames {
+		if flags&f.flag != 0 {
+			res = append(res, f.name)
+		}
+	}
+	return res
+}
+
+func (flags SysmonFlag) String() string {
+	alarms := flags.Alarms()
+	if len(alarms) == 0 {
+		return "none"
+	}
+	return strings.Join(alarms, ",")
+}